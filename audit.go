@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	cAuditTable            = "import_finos_identities_audit"
+	cAuditEnrollmentAdd    = "enrollment_add"
+	cAuditEnrollmentDelete = "enrollment_delete"
+	cAuditProfileUpdate    = "profile_update"
+)
+
+var gRunID string
+
+// auditLog - writes audit record for every change import makes to SortingHat database
+// Disable it via NO_AUDIT=1
+type auditLog struct {
+	enabled bool
+}
+
+type auditEntry struct {
+	ID           int
+	RunID        string
+	DtCreated    time.Time
+	UUID         string
+	Action       string
+	OldValue     *string
+	NewValue     *string
+	SourceFile   *string
+	SourceLine   *int
+	SourceRecord *string
+}
+
+func newRunID() string {
+	dt := time.Now().UTC()
+	return fmt.Sprintf("%04d%02d%02d%02d%02d%02d-%d", dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second(), os.Getpid())
+}
+
+func newAuditLog(store shStorage) *auditLog {
+	audit := &auditLog{enabled: os.Getenv("NO_AUDIT") == ""}
+	if audit.enabled {
+		fatalOnError(store.ensureAuditTable())
+	}
+	return audit
+}
+
+func (a *auditLog) log(store shStorage, uidentity *shUIdentity, action string, oldValue, newValue *string) {
+	if !a.enabled {
+		return
+	}
+	fatalOnError(store.addAuditEntry(newAuditEntry(uidentity, action, oldValue, newValue)))
+}
+
+func (a *auditLog) enrollmentAdded(store shStorage, uidentity *shUIdentity, enrollment *shEnrollment) {
+	newValue := enrollment.String()
+	a.log(store, uidentity, cAuditEnrollmentAdd, nil, &newValue)
+}
+
+func (a *auditLog) enrollmentDeleted(store shStorage, uidentity *shUIdentity, enrollment *shEnrollment) {
+	oldValue := enrollment.String()
+	a.log(store, uidentity, cAuditEnrollmentDelete, &oldValue, nil)
+}
+
+func (a *auditLog) profileUpdated(store shStorage, uidentity *shUIdentity, existing, updated *shProfile) {
+	oldValue, newValue := existing.String(), updated.String()
+	a.log(store, uidentity, cAuditProfileUpdate, &oldValue, &newValue)
+}
+
+// printHistory - prints everything import ever did to a given uuid
+func printHistory(store shStorage, uuid string) {
+	entries, err := store.auditEntries(uuid)
+	fatalOnError(err)
+	optional := func(s *string) string {
+		if s == nil {
+			return nils
+		}
+		return *s
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s run %s: %s\n", entry.DtCreated.Format(time.RFC3339Nano), entry.RunID, entry.Action)
+		source := optional(entry.SourceFile)
+		if entry.SourceLine != nil {
+			source += fmt.Sprintf(":%d", *entry.SourceLine)
+		}
+		fmt.Printf("  old: %s\n  new: %s\n  source: %s\n", optional(entry.OldValue), optional(entry.NewValue), source)
+		if entry.SourceRecord != nil {
+			fmt.Printf("  source record:\n    %s\n", strings.Replace(strings.TrimSpace(*entry.SourceRecord), "\n", "\n    ", -1))
+		}
+	}
+	fmt.Printf("%d audit entries for %s\n", len(entries), uuid)
+}
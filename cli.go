@@ -0,0 +1,388 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setting kinds
+const (
+	cKindString   = "string"
+	cKindBool     = "bool"
+	cKindInt      = "int"
+	cKindDuration = "duration"
+)
+
+// settings groups, each subcommand uses some of them
+const (
+	cGroupDB     = "db"
+	cGroupImport = "import"
+	cGroupLog    = "log"
+)
+
+// setting - single configuration value, it can be given via flag, environment variable or config file
+// Flag name is env name in lower kebab case (PROJECT_SLUG -> --project-slug), config file key is env name
+// in lower snake case (PROJECT_SLUG -> project_slug)
+// Precedence: flag, then environment variable, then config file
+type setting struct {
+	env     string
+	kind    string
+	group   string
+	help    string
+	allowed []string
+}
+
+var gSettings = []setting{
+	{env: "SH_DSN", kind: cKindString, group: cGroupDB, help: "full database DSN, when set other SH_ connection settings are not used"},
+	{env: "SH_USR", kind: cKindString, group: cGroupDB, help: "database user"},
+	{env: "SH_PASS", kind: cKindString, group: cGroupDB, help: "database password"},
+	{env: "SH_PROTO", kind: cKindString, group: cGroupDB, help: "database protocol (default tcp)"},
+	{env: "SH_HOST", kind: cKindString, group: cGroupDB, help: "database host (default localhost)"},
+	{env: "SH_PORT", kind: cKindString, group: cGroupDB, help: "database port (default 3306)"},
+	{env: "SH_DB", kind: cKindString, group: cGroupDB, help: "database name"},
+	{env: "SH_PARAMS", kind: cKindString, group: cGroupDB, help: "DSN parameters (default ?charset=utf8&parseTime=true), - means none"},
+	{env: "SH_SQLITE", kind: cKindString, group: cGroupDB, help: "SQLite database file with SortingHat schema, when set MariaDB connection settings are not used"},
+	{env: "SH_SQLITE_CREATE", kind: cKindBool, group: cGroupDB, help: "create missing SortingHat tables in SH_SQLITE file"},
+	{env: "SH_GRAPHQL_URL", kind: cKindString, group: cGroupDB, help: "SortingHat GraphQL API URL, for example http://sortinghat:8000/api/, when set database settings are not used"},
+	{env: "SH_GRAPHQL_TOKEN", kind: cKindString, group: cGroupDB, help: "SortingHat GraphQL API JWT token"},
+	{env: "SH_GRAPHQL_USER", kind: cKindString, group: cGroupDB, help: "SortingHat GraphQL API user, used to get token when SH_GRAPHQL_TOKEN is not set"},
+	{env: "SH_GRAPHQL_PASS", kind: cKindString, group: cGroupDB, help: "SortingHat GraphQL API password"},
+	{env: "SH_GRAPHQL_TIMEOUT", kind: cKindDuration, group: cGroupDB, help: "SortingHat GraphQL API request timeout (default 30s)"},
+	{env: "SH_GRAPHQL_AUDIT_FILE", kind: cKindString, group: cGroupDB, help: "audit JSON lines file used with GraphQL API (default " + cAuditTable + ".jsonl)"},
+	{env: "SH_MAX_OPEN_CONNS", kind: cKindInt, group: cGroupDB, help: "max open connections (default number of workers + 2)"},
+	{env: "SH_MAX_IDLE_CONNS", kind: cKindInt, group: cGroupDB, help: "max idle connections (default max open connections)"},
+	{env: "SH_CONN_MAX_LIFETIME", kind: cKindDuration, group: cGroupDB, help: "max connection lifetime (default 5m)"},
+	{env: "SH_CONN_MAX_IDLE_TIME", kind: cKindDuration, group: cGroupDB, help: "max connection idle time (default 1m)"},
+	{env: "SH_RETRIES", kind: cKindInt, group: cGroupDB, help: "retries of queries failing with retryable errors (default 5)"},
+	{env: "SH_RETRY_DELAY", kind: cKindDuration, group: cGroupDB, help: "delay before the first retry (default 200ms)"},
+	{env: "SH_PING_TIMEOUT", kind: cKindDuration, group: cGroupDB, help: "database connectivity check timeout (default 10s)"},
+	{env: "SKIP_SCHEMA_CHECK", kind: cKindBool, group: cGroupImport, help: "don't check SortingHat schema before import"},
+	{env: "UPDATE_PROFILES", kind: cKindBool, group: cGroupImport, help: "update profile email, gender, country_code and is_bot given in identities files when they differ"},
+	{env: "SKIP_VALIDATION", kind: cKindBool, group: cGroupImport, help: "don't validate identities files before import"},
+	{env: "EXTRA_SOURCES", kind: cKindString, group: cGroupImport, help: "comma separated data source keys allowed in identities files in addition to known ones"},
+	{env: "DRY", kind: cKindBool, group: cGroupImport, help: "dry-run mode, lookup identities and write reports but don't sync enrollments"},
+	{env: "REPLACE", kind: cKindBool, group: cGroupImport, help: "replace existing enrollments that differ from imported ones, without COMPARE all of them are replaced on every run (warning)"},
+	{env: "COMPARE", kind: cKindBool, group: cGroupImport, help: "compare imported profiles, identities and enrollments with existing ones"},
+	{env: "PROJECT_SLUG", kind: cKindString, group: cGroupImport, help: "project slug to import enrollments into (default null project slug)"},
+	{env: "PROJECTS_MANIFEST", kind: cKindString, group: cGroupImport, help: "YAML manifest mapping input files to project slugs"},
+	{env: "ORGS_MAP_FILE", kind: cKindString, group: cGroupImport, help: "YAML file with organization names mappings"},
+	{env: "MERGE_POLICY", kind: cKindString, group: cGroupImport, help: "merging the same person from multiple files", allowed: []string{cMergeOrder, cMergeNewest, cMergeUnion}},
+	{env: "DUPLICATES_POLICY", kind: cKindString, group: cGroupImport, help: "the same person defined more than once in a single file", allowed: []string{cDuplicatesMerge, cDuplicatesReject}},
+	{env: "OWNERSHIP", kind: cKindString, group: cGroupImport, help: "which existing enrollments import can replace (default all)", allowed: []string{cOwnershipAll, cOwnershipOwn, cOwnershipRank}},
+	{env: "ORIGINS_PRECEDENCE", kind: cKindString, group: cGroupImport, help: "comma separated origins, from the most important (requires ownership precedence)"},
+	{env: "ENROLLMENTS_ORIGIN_COLUMN", kind: cKindString, group: cGroupImport, help: "enrollments origin column (default origin)"},
+	{env: "NO_AUDIT", kind: cKindBool, group: cGroupImport, help: "don't write audit records"},
+	{env: "ORDERED", kind: cKindBool, group: cGroupImport, help: "deterministic logs and reports"},
+	{env: "MISSING_PROFILES_CSV", kind: cKindString, group: cGroupImport, help: "missing profiles report file name prefix (default missing_profiles)"},
+	{env: "MISSING_ORGS_CSV", kind: cKindString, group: cGroupImport, help: "missing organizations report file name prefix (default missing_orgs)"},
+	{env: "DUPLICATES_CSV", kind: cKindString, group: cGroupImport, help: "duplicates report file name prefix (default duplicates)"},
+	{env: "FILE_CONFLICTS_CSV", kind: cKindString, group: cGroupImport, help: "multiple files conflicts report file name prefix (default file_conflicts)"},
+	{env: "ORIGIN_CONFLICTS_CSV", kind: cKindString, group: cGroupImport, help: "origin conflicts report file name prefix (default origin_conflicts)"},
+	{env: "SUMMARY_JSON", kind: cKindString, group: cGroupImport, help: "JSON run summary file (default import_finos_identities_summary_<run id>.json)"},
+	{env: "METRICS_TEXTFILE", kind: cKindString, group: cGroupImport, help: "save Prometheus metrics into this node_exporter textfile"},
+	{env: "METRICS_PUSH_URL", kind: cKindString, group: cGroupImport, help: "push Prometheus metrics to this Pushgateway URL"},
+	{env: "METRICS_JOB", kind: cKindString, group: cGroupImport, help: "Pushgateway job name (default import_finos_identities)"},
+	{env: "METRICS_PUSH_TIMEOUT", kind: cKindDuration, group: cGroupImport, help: "Pushgateway push timeout (default 10s)"},
+	{env: "ST", kind: cKindBool, group: cGroupImport, help: "single threaded mode"},
+	{env: "NCPUS", kind: cKindInt, group: cGroupImport, help: "max number of threads (default number of CPUs)"},
+	{env: "LOOKUP_THREADS", kind: cKindInt, group: cGroupImport, help: "lookups and organizations mapping workers"},
+	{env: "WRITE_THREADS", kind: cKindInt, group: cGroupImport, help: "enrollments sync workers"},
+	{env: "LOG_LEVEL", kind: cKindString, group: cGroupLog, help: "log level", allowed: gLevelNames},
+	{env: "LOG_FORMAT", kind: cKindString, group: cGroupLog, help: "log format", allowed: []string{cLogFormatLogfmt, cLogFormatJSON}},
+	{env: "LOG_REDACT_EMAILS", kind: cKindBool, group: cGroupLog, help: "redact emails in logs"},
+	{env: "DEBUG", kind: cKindBool, group: cGroupLog, help: "same as log level debug"},
+	{env: "DEBUG_SQL", kind: cKindBool, group: cGroupLog, help: "same as log level sql"},
+}
+
+// command - subcommand, run gets positional arguments (after flags)
+type command struct {
+	name   string
+	args   string
+	help   string
+	groups []string
+	run    func(args []string) int
+}
+
+var gCommands []command
+
+func init() {
+	gCommands = []command{
+		{name: "import", args: "[file.yaml ...]", help: "import identities files (files can be omitted when projects manifest is used)", groups: []string{cGroupDB, cGroupImport, cGroupLog}, run: runImport},
+		{name: "history", args: "uuid [uuid ...]", help: "print audit history of given profiles", groups: []string{cGroupDB, cGroupLog}, run: runHistory},
+		{name: "validate", args: "[file.yaml ...]", help: "validate identities files and report all problems with file:line (no database needed)", groups: []string{cGroupImport, cGroupLog}, run: runValidate},
+		{name: "check-schema", args: "", help: "check SortingHat schema is compatible with import settings", groups: []string{cGroupDB, cGroupImport, cGroupLog}, run: runCheckSchema},
+		{name: "create-schema", args: "", help: "create SortingHat tables in SH_SQLITE file", groups: []string{cGroupDB, cGroupLog}, run: runCreateSchema},
+	}
+}
+
+func (s *setting) flagName() string {
+	return strings.Replace(strings.ToLower(s.env), "_", "-", -1)
+}
+
+func (s *setting) configKey() string {
+	return strings.ToLower(s.env)
+}
+
+func (c *command) uses(group string) bool {
+	for _, g := range c.groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func findCommand(name string) *command {
+	for i := range gCommands {
+		if gCommands[i].name == name {
+			return &gCommands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	for _, cmd := range gCommands {
+		fmt.Fprintf(os.Stderr, "  %s\n      %s\n", strings.TrimSpace(os.Args[0]+" "+cmd.name+" [flags] "+cmd.args), cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "  %s help [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Command defaults to import, so %s [flags] file.yaml works too.\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Every flag can also be set via environment variable (shown in brackets) or in YAML config file (--config)\n")
+	fmt.Fprintf(os.Stderr, "using lower case variable name as a key, precedence: flag, environment variable, config file.\n")
+}
+
+// readConfigFile - returns settings from YAML config file as environment values
+func readConfigFile(fileName string) map[string]string {
+	values := make(map[string]string)
+	if fileName == "" {
+		return values
+	}
+	data, err := ioutil.ReadFile(fileName)
+	fatalOnError(err)
+	var config map[string]interface{}
+	fatalOnError(yaml.Unmarshal(data, &config))
+	keys := []string{}
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var s *setting
+		for i := range gSettings {
+			if gSettings[i].configKey() == key {
+				s = &gSettings[i]
+				break
+			}
+		}
+		if s == nil {
+			fatalf("%s: unknown setting '%s'", fileName, key)
+		}
+		switch value := config[key].(type) {
+		case nil:
+			continue
+		case bool:
+			if s.kind != cKindBool {
+				fatalf("%s: setting '%s' is not a boolean", fileName, key)
+			}
+			if value {
+				values[s.env] = "1"
+			}
+		default:
+			if s.kind == cKindBool {
+				fatalf("%s: setting '%s' must be true or false", fileName, key)
+			}
+			values[s.env] = fmt.Sprintf("%v", value)
+		}
+	}
+	return values
+}
+
+// parseCommandLine - parses command line, applies config file and flags to environment, returns command and its arguments
+// Config file values are only used for variables not set in environment, flags given explicitly always win
+func parseCommandLine(args []string) (*command, []string, int) {
+	name := "import"
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			if len(args) > 1 && findCommand(args[1]) != nil {
+				return parseCommandLine([]string{args[1], "--help"})
+			}
+			usage()
+			return nil, nil, 0
+		}
+		if findCommand(args[0]) != nil {
+			name = args[0]
+			args = args[1:]
+		}
+	}
+	cmd := findCommand(name)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	config := fs.String("config", os.Getenv("CONFIG"), "YAML config file [CONFIG]")
+	bools := make(map[string]*bool)
+	strs := make(map[string]*string)
+	for i := range gSettings {
+		s := &gSettings[i]
+		if !cmd.uses(s.group) {
+			continue
+		}
+		help := s.help
+		if len(s.allowed) > 0 {
+			help += ": " + strings.Join(s.allowed, ", ")
+		}
+		help += " [" + s.env + "]"
+		if s.kind == cKindBool {
+			bools[s.env] = fs.Bool(s.flagName(), false, help)
+			continue
+		}
+		strs[s.env] = fs.String(s.flagName(), "", help)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n  %s\n\nFlags:\n", strings.TrimSpace(os.Args[0]+" "+cmd.name+" [flags] "+cmd.args), cmd.help)
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return nil, nil, 0
+	}
+	if err != nil {
+		return nil, nil, 2
+	}
+	for env, value := range readConfigFile(*config) {
+		_, ok := os.LookupEnv(env)
+		if !ok {
+			fatalOnError(os.Setenv(env, value))
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for i := range gSettings {
+			s := &gSettings[i]
+			if s.flagName() != f.Name {
+				continue
+			}
+			value := ""
+			if s.kind == cKindBool {
+				if *bools[s.env] {
+					value = "1"
+				}
+			} else {
+				value = *strs[s.env]
+			}
+			fatalOnError(os.Setenv(s.env, value))
+		}
+	})
+	err = validateSettings(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil, nil, 2
+	}
+	configureLogging()
+	warnSettings(cmd)
+	return cmd, fs.Args(), 0
+}
+
+// validateSettings - checks values of all settings used by a command and incompatible combinations
+func validateSettings(cmd *command) error {
+	for i := range gSettings {
+		s := &gSettings[i]
+		value := os.Getenv(s.env)
+		if !cmd.uses(s.group) || value == "" {
+			continue
+		}
+		switch s.kind {
+		case cKindInt:
+			_, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: '%s' is not a number", s.env, value)
+			}
+		case cKindDuration:
+			_, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: '%s' is not a duration (for example 10s, 5m)", s.env, value)
+			}
+		}
+		if len(s.allowed) > 0 {
+			found := false
+			for _, allowed := range s.allowed {
+				if value == allowed {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s: unknown value '%s', allowed: %s", s.env, value, strings.Join(s.allowed, ", "))
+			}
+		}
+	}
+	set := func(env string) bool {
+		return os.Getenv(env) != ""
+	}
+	if cmd.uses(cGroupImport) {
+		if set("ORIGINS_PRECEDENCE") && os.Getenv("OWNERSHIP") != cOwnershipRank {
+			return fmt.Errorf("ORIGINS_PRECEDENCE is only used with OWNERSHIP=%s", cOwnershipRank)
+		}
+		if os.Getenv("OWNERSHIP") == cOwnershipRank && !set("ORIGINS_PRECEDENCE") {
+			return fmt.Errorf("OWNERSHIP=%s requires ORIGINS_PRECEDENCE", cOwnershipRank)
+		}
+		if set("ST") && (set("NCPUS") || set("LOOKUP_THREADS") || set("WRITE_THREADS")) {
+			return fmt.Errorf("ST (single threaded mode) cannot be used with NCPUS, LOOKUP_THREADS or WRITE_THREADS")
+		}
+	}
+	if cmd.uses(cGroupDB) && !set("SH_DSN") && !set("SH_DB") && !set("SH_SQLITE") && !set("SH_GRAPHQL_URL") {
+		return fmt.Errorf("database is not configured, use SH_DSN or SH_DB (and other SH_ connection settings), SH_SQLITE or SH_GRAPHQL_URL")
+	}
+	if cmd.uses(cGroupDB) && cmd.uses(cGroupImport) && set("SH_GRAPHQL_URL") {
+		if set("OWNERSHIP") && os.Getenv("OWNERSHIP") != cOwnershipAll {
+			return fmt.Errorf("SortingHat GraphQL API has no enrollments origins, SH_GRAPHQL_URL requires OWNERSHIP=%s", cOwnershipAll)
+		}
+		if set("PROJECT_SLUG") {
+			return fmt.Errorf("SortingHat GraphQL API has no project slugs, SH_GRAPHQL_URL cannot be used with PROJECT_SLUG")
+		}
+		// per-enrollment and per-person project slugs in input files are checked once files are read, before any change
+		for _, file := range readProjectsManifest(os.Getenv("PROJECTS_MANIFEST")).Files {
+			for _, slug := range file.ProjectSlugs {
+				if slug != nil {
+					return fmt.Errorf("SortingHat GraphQL API has no project slugs, PROJECTS_MANIFEST maps %s to project '%s'", file.File, *slug)
+				}
+			}
+		}
+	}
+	if cmd.uses(cGroupDB) && set("SH_SQLITE_CREATE") && !set("SH_SQLITE") {
+		return fmt.Errorf("SH_SQLITE_CREATE requires SH_SQLITE")
+	}
+	return nil
+}
+
+// warnSettings - logs settings combinations that are allowed but probably not intended
+func warnSettings(cmd *command) {
+	set := func(env string) bool {
+		return os.Getenv(env) != ""
+	}
+	if cmd.uses(cGroupImport) && set("REPLACE") && !set("COMPARE") {
+		gLog.warn("REPLACE without COMPARE deletes and adds all enrollments again on every run")
+	}
+	if cmd.uses(cGroupImport) && set("PROJECT_SLUG") && set("PROJECTS_MANIFEST") {
+		gLog.warn("PROJECT_SLUG is only used for files not listed in PROJECTS_MANIFEST")
+	}
+	if cmd.uses(cGroupDB) && set("SH_GRAPHQL_URL") && (set("SH_SQLITE") || set("SH_DSN") || set("SH_DB")) {
+		gLog.warn("SH_GRAPHQL_URL is set, database connection settings are ignored")
+	}
+	if cmd.uses(cGroupDB) && set("SH_SQLITE") && (set("SH_DSN") || set("SH_DB")) {
+		gLog.warn("SH_SQLITE is set, MariaDB connection settings are ignored")
+	}
+	if cmd.uses(cGroupDB) && set("SH_DSN") {
+		for _, env := range []string{"SH_USR", "SH_PASS", "SH_PROTO", "SH_HOST", "SH_PORT", "SH_DB", "SH_PARAMS"} {
+			if set(env) {
+				gLog.warn("SH_DSN is set, other connection settings are ignored", "ignored", env)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	cPrecisionDay = iota
+	cPrecisionMonth
+	cPrecisionYear
+)
+
+// gEnrollmentDateLayouts - accepted enrollment date formats, partial dates are rounded to the start of a period for start dates
+// and to the last day of a period for end dates (2019-05 is 2019-05-01 as start and 2019-05-31 as end)
+// Ambiguous day/month orders like 01/05/2019 are not accepted
+var gEnrollmentDateLayouts = []struct {
+	layout    string
+	precision int
+}{
+	{time.RFC3339Nano, cPrecisionDay},
+	{"2006-1-2 15:4:5", cPrecisionDay},
+	{"2006-1-2", cPrecisionDay},
+	{"2006/1/2", cPrecisionDay},
+	{"2006.1.2", cPrecisionDay},
+	{"2006-1", cPrecisionMonth},
+	{"2006/1", cPrecisionMonth},
+	{"January 2006", cPrecisionMonth},
+	{"Jan 2006", cPrecisionMonth},
+	{"2006", cPrecisionYear},
+}
+
+// gOpenDates - values meaning there is no start/end date (present is only allowed for end dates)
+var gOpenDates = map[string]struct{}{"": {}, "~": {}, "null": {}, "present": {}, "now": {}, "current": {}}
+
+// parseEnrollmentDate - parses enrollment start (end=false) or end date, open dates are returned as default start/end dates
+func parseEnrollmentDate(value string, end bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	lValue := strings.ToLower(value)
+	if _, ok := gOpenDates[lValue]; ok {
+		if !end {
+			if lValue != "" && lValue != "~" && lValue != "null" {
+				return time.Time{}, fmt.Errorf("start date cannot be '%s', use null for unknown start", value)
+			}
+			return gDefaultStartDate, nil
+		}
+		return gDefaultEndDate, nil
+	}
+	for _, l := range gEnrollmentDateLayouts {
+		dt, err := time.Parse(l.layout, value)
+		if err != nil {
+			continue
+		}
+		if !end {
+			return dt, nil
+		}
+		switch l.precision {
+		case cPrecisionMonth:
+			dt = time.Date(dt.Year(), dt.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+		case cPrecisionYear:
+			dt = time.Date(dt.Year(), 12, 31, 0, 0, 0, 0, time.UTC)
+		}
+		return dt, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse date '%s', expected YYYY-MM-DD, YYYY/MM/DD, YYYY-MM, Month YYYY, YYYY, null or present (end only)", value)
+}
+
+// parseEnrollmentDateNode - parses enrollment date YAML value (missing value is an open date)
+func parseEnrollmentDateNode(node *yaml.Node, end bool) (time.Time, error) {
+	if node.Kind == 0 || (node.Kind == yaml.ScalarNode && node.Tag == "!!null") {
+		return parseEnrollmentDate("", end)
+	}
+	if node.Kind != yaml.ScalarNode {
+		return time.Time{}, fmt.Errorf("date must be a single value")
+	}
+	return parseEnrollmentDate(node.Value, end)
+}
+
+// UnmarshalYAML - decodes enrollment from identities file, dates are parsed by parseEnrollmentDate
+func (e *shEnrollment) UnmarshalYAML(node *yaml.Node) error {
+	var raw struct {
+		Organization string    `yaml:"organization"`
+		Start        yaml.Node `yaml:"start"`
+		End          yaml.Node `yaml:"end"`
+		ProjectSlug  *string   `yaml:"project_slug"`
+	}
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+	*e = shEnrollment{Organization: raw.Organization, ProjectSlug: raw.ProjectSlug}
+	e.Start, err = parseEnrollmentDateNode(&raw.Start, false)
+	if err != nil {
+		return fmt.Errorf("line %d: enrollment in '%s': start: %v", raw.Start.Line, raw.Organization, err)
+	}
+	e.End, err = parseEnrollmentDateNode(&raw.End, true)
+	if err != nil {
+		return fmt.Errorf("line %d: enrollment in '%s': end: %v", raw.End.Line, raw.Organization, err)
+	}
+	return nil
+}
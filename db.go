@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	gRetries    = 5
+	gRetryDelay = 200 * time.Millisecond
+)
+
+const cMaxRetryDelay = 10 * time.Second
+
+func getEnvInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	fatalOnError(err)
+	return n
+}
+
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	fatalOnError(err)
+	return d
+}
+
+// configureDB - sets connection pool limits and retries configuration
+// SH_MAX_OPEN_CONNS - max number of open connections, defaults to number of workers + 2
+// SH_MAX_IDLE_CONNS - max number of idle connections, defaults to SH_MAX_OPEN_CONNS
+// SH_CONN_MAX_LIFETIME - max time connection can be reused, for example "5m" (default)
+// SH_CONN_MAX_IDLE_TIME - max time connection can be idle, for example "1m" (default)
+// SH_RETRIES - how many times to retry query/exec failing with a retryable error (deadlock, lost connection, ...), default 5
+// writes are only retried when they certainly were not applied (deadlock, lock wait timeout, ...)
+// SH_RETRY_DELAY - delay before the first retry, doubled after each retry (up to 10s), default "200ms"
+func configureDB(db *sql.DB) {
+	workers := getPhaseThreadsNum("LOOKUP_THREADS")
+	writers := getPhaseThreadsNum("WRITE_THREADS")
+	if writers > workers {
+		workers = writers
+	}
+	maxOpen := getEnvInt("SH_MAX_OPEN_CONNS", workers+2)
+	maxIdle := getEnvInt("SH_MAX_IDLE_CONNS", maxOpen)
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(getEnvDuration("SH_CONN_MAX_LIFETIME", 5*time.Minute))
+	db.SetConnMaxIdleTime(getEnvDuration("SH_CONN_MAX_IDLE_TIME", time.Minute))
+	gRetries = getEnvInt("SH_RETRIES", gRetries)
+	gRetryDelay = getEnvDuration("SH_RETRY_DELAY", gRetryDelay)
+}
+
+// originConnector - sets @origin session variable (used by SortingHat enrollments triggers) on every new connection
+// Connections are pooled, replaced after SH_CONN_MAX_LIFETIME and reopened after errors, so setting it once is not enough
+type originConnector struct {
+	driver.Connector
+	origin string
+}
+
+func (c *originConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		_ = conn.Close()
+		return nil, fmt.Errorf("database driver cannot set @origin on a new connection")
+	}
+	_, err = execer.ExecContext(ctx, "set @origin = '"+strings.Replace(c.origin, "'", "''", -1)+"'", nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// openMySQL - opens MariaDB connections pool, every connection has @origin set to a given origin
+func openMySQL(dsn, origin string) (*sql.DB, error) {
+	connector, err := mysql.MySQLDriver{}.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(&originConnector{Connector: connector, origin: origin}), nil
+}
+
+// pingDB - checks database connectivity, fails when database cannot be reached within SH_PING_TIMEOUT (default "10s")
+func pingDB(db *sql.DB) {
+	timeout := getEnvDuration("SH_PING_TIMEOUT", 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := db.PingContext(ctx)
+	if err != nil {
+		fatalf("cannot connect to database within %v: %v", timeout, err)
+	}
+}
+
+// isRetryable - errors that are worth retrying: deadlocks, lock wait timeouts, lost/broken connections, locked SQLite database,
+// GraphQL API server errors
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isRetryableWrite(err) || err == mysql.ErrInvalidConn {
+		return true
+	}
+	if hErr, ok := err.(*gqlHTTPError); ok {
+		return hErr.status >= 500
+	}
+	if mErr, ok := err.(*mysql.MySQLError); ok {
+		switch mErr.Number {
+		// CR_SERVER_GONE_ERROR, CR_SERVER_LOST
+		case 2006, 2013:
+			return true
+		}
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection reset", "broken pipe", "bad connection", "i/o timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryableWrite - errors after which a write was certainly not applied, so it can be retried without creating duplicates:
+// deadlocks and lock wait timeouts (statement rolled back), too many connections, refused connections and locked SQLite database
+// Lost connections and timeouts are not retried, statement may have already been committed
+func isRetryableWrite(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn {
+		return true
+	}
+	if mErr, ok := err.(*mysql.MySQLError); ok {
+		switch mErr.Number {
+		// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT, ER_CON_COUNT_ERROR
+		case 1213, 1205, 1040:
+			return true
+		}
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection refused", "database is locked"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry - calls f until it succeeds, fails with non-retryable error or retries are exhausted, only for reads
+func withRetry(what string, f func() error) error {
+	return retry(what, isRetryable, f)
+}
+
+// withWriteRetry - like withRetry but only retries errors after which the write was not applied (see isRetryableWrite)
+func withWriteRetry(what string, f func() error) error {
+	return retry(what, isRetryableWrite, f)
+}
+
+func retry(what string, retryable func(error) bool, f func() error) (err error) {
+	delay := gRetryDelay
+	for i := 0; ; i++ {
+		err = f()
+		if err == nil || i >= gRetries || !retryable(err) {
+			return
+		}
+		gLog.warn("retryable error, retrying", "retry", i+1, "retries", gRetries, "sql", what, "error", err, "delay", delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > cMaxRetryDelay {
+			delay = cMaxRetryDelay
+		}
+	}
+}
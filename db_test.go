@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeConn - records statements executed on a connection, fails them when fail is set
+type fakeConn struct {
+	execs  *[]string
+	closed bool
+	fail   bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.fail {
+		return nil, fmt.Errorf("exec failed")
+	}
+	*c.execs = append(*c.execs, query)
+	return driver.RowsAffected(0), nil
+}
+
+type fakeConnector struct {
+	execs []string
+	conns []*fakeConn
+	fail  bool
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn := &fakeConn{execs: &c.execs, fail: c.fail}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+// TestOriginConnector - every new connection gets @origin set, connection is closed when it cannot be set
+func TestOriginConnector(t *testing.T) {
+	fake := &fakeConnector{}
+	connector := &originConnector{Connector: fake, origin: cOrigin}
+	for i := 0; i < 2; i++ {
+		_, err := connector.Connect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "set @origin = 'import-finos-identities'"
+	if len(fake.execs) != 2 || fake.execs[0] != expected || fake.execs[1] != expected {
+		t.Fatalf("expected %q on both connections, got %v", expected, fake.execs)
+	}
+	fake.fail = true
+	_, err := connector.Connect(context.Background())
+	if err == nil || !fake.conns[2].closed {
+		t.Fatalf("connection without @origin must fail and be closed, error: %v", err)
+	}
+}
+
+func TestIsRetryableWrite(t *testing.T) {
+	cases := []struct {
+		err   error
+		read  bool
+		write bool
+	}{
+		{err: &mysql.MySQLError{Number: 1213}, read: true, write: true},
+		{err: &mysql.MySQLError{Number: 1205}, read: true, write: true},
+		{err: &mysql.MySQLError{Number: 2013}, read: true, write: false},
+		{err: &mysql.MySQLError{Number: 1062}, read: false, write: false},
+		{err: mysql.ErrInvalidConn, read: true, write: false},
+		{err: driver.ErrBadConn, read: true, write: true},
+		{err: fmt.Errorf("read tcp: i/o timeout"), read: true, write: false},
+		{err: fmt.Errorf("dial tcp: connection refused"), read: true, write: true},
+		{err: &gqlHTTPError{status: 502}, read: true, write: false},
+	}
+	for _, tc := range cases {
+		if isRetryable(tc.err) != tc.read || isRetryableWrite(tc.err) != tc.write {
+			t.Errorf("%v: expected retryable read %v, write %v", tc.err, tc.read, tc.write)
+		}
+	}
+}
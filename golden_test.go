@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// golden case directory layout, see README
+const (
+	cGoldenSeed     = "seed.yaml"
+	cGoldenInput    = "identities.yaml"
+	cGoldenOrgsMap  = "map_org_names.yaml"
+	cGoldenConfig   = "config.yaml"
+	cGoldenExpected = "expected"
+	cGoldenDir      = "testdata/golden"
+)
+
+// gGoldenModes - import modes each golden case is run in, every mode starts from the same seed
+var gGoldenModes = []struct {
+	name string
+	env  map[string]string
+}{
+	{name: "dry", env: map[string]string{"DRY": "1"}},
+	{name: "compare", env: map[string]string{"COMPARE": "1"}},
+	{name: "replace", env: map[string]string{"COMPARE": "1", "REPLACE": "1"}},
+}
+
+// gGoldenReports - report CSVs compared with expected ones, prefix -> golden file name
+var gGoldenReports = [][2]string{
+	{"missing_orgs_", "missing_orgs.csv"},
+	{"missing_profiles_", "missing_profiles.csv"},
+}
+
+// goldenSeed - SortingHat dataset existing before import, organization ids are assigned in the order given
+type goldenSeed struct {
+	Organizations []string `yaml:"organizations"`
+	Profiles      []struct {
+		UUID        string  `yaml:"uuid"`
+		Name        string  `yaml:"name"`
+		Email       *string `yaml:"email"`
+		Gender      *string `yaml:"gender"`
+		CountryCode *string `yaml:"country_code"`
+		IsBot       *bool   `yaml:"is_bot"`
+		Identities  []struct {
+			Source   string  `yaml:"source"`
+			Name     string  `yaml:"name"`
+			Email    *string `yaml:"email"`
+			Username string  `yaml:"username"`
+		} `yaml:"identities"`
+	} `yaml:"profiles"`
+	Enrollments []struct {
+		UUID         string     `yaml:"uuid"`
+		Organization string     `yaml:"organization"`
+		Start        *time.Time `yaml:"start"`
+		End          *time.Time `yaml:"end"`
+		ProjectSlug  *string    `yaml:"project_slug"`
+		Origin       *string    `yaml:"origin"`
+	} `yaml:"enrollments"`
+}
+
+// loadGoldenSeed - creates in-memory SortingHat with a given seed file data
+func loadGoldenSeed(fileName string) (*memoryStorage, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var seed goldenSeed
+	err = yaml.Unmarshal(data, &seed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	st := newMemoryStorage()
+	orgs := make(map[string]int)
+	for _, org := range seed.Organizations {
+		orgs[org] = st.addOrganization(org)
+	}
+	for _, p := range seed.Profiles {
+		identities := []memoryIdentity{}
+		for _, i := range p.Identities {
+			identities = append(identities, memoryIdentity{source: i.Source, name: i.Name, email: i.Email, username: i.Username})
+		}
+		st.addProfile(shProfile{UUID: p.UUID, Name: p.Name, Email: p.Email, Gender: p.Gender, CountryCode: p.CountryCode, IsBot: p.IsBot}, identities...)
+	}
+	for _, e := range seed.Enrollments {
+		orgID, ok := orgs[e.Organization]
+		if !ok {
+			return nil, fmt.Errorf("%s: enrollment of %s in unknown organization '%s'", fileName, e.UUID, e.Organization)
+		}
+		enrollment := shEnrollment{UUID: e.UUID, OrgID: orgID, Start: gDefaultStartDate, End: gDefaultEndDate, ProjectSlug: e.ProjectSlug, Origin: e.Origin}
+		if e.Start != nil {
+			enrollment.Start = *e.Start
+		}
+		if e.End != nil {
+			enrollment.End = *e.End
+		}
+		st.addEnrollmentRow(enrollment)
+	}
+	return st, nil
+}
+
+func csvString(header []string, rows [][]string) string {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return strings.Join(rows[i], "\x00") < strings.Join(rows[j], "\x00")
+	})
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	fatalOnError(writer.Write(header))
+	fatalOnError(writer.WriteAll(rows))
+	return buf.String()
+}
+
+func nullable(s *string) string {
+	if s == nil {
+		return "null"
+	}
+	return *s
+}
+
+// goldenTables - post-import SortingHat tables in golden CSV format, golden file name -> contents
+func goldenTables(st *memoryStorage) map[string]string {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	tables := make(map[string]string)
+	rows := [][]string{}
+	for uuid, profile := range st.profiles {
+		isBot := "null"
+		if profile.IsBot != nil {
+			isBot = fmt.Sprintf("%v", *profile.IsBot)
+		}
+		rows = append(rows, []string{uuid, profile.Name, nullable(profile.Email), nullable(profile.Gender), nullable(profile.CountryCode), isBot})
+	}
+	tables["profiles.csv"] = csvString([]string{"UUID", "Name", "Email", "Gender", "Country Code", "Is Bot"}, rows)
+	rows = [][]string{}
+	for _, rol := range st.rols {
+		rows = append(rows, []string{rol.UUID, st.orgs[rol.OrgID], toYMDDate(rol.Start), toYMDDate(rol.End), slugKey(rol.ProjectSlug), nullable(rol.Origin)})
+	}
+	tables["enrollments.csv"] = csvString([]string{"UUID", "Organization", "Start", "End", "Project Slug", "Origin"}, rows)
+	// entries of different profiles are written concurrently, so only order within a profile is stable
+	entries := append([]auditEntry{}, st.audit...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].UUID == entries[j].UUID {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].UUID < entries[j].UUID
+	})
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	fatalOnError(writer.Write([]string{"UUID", "Action", "Old Value", "New Value", "Source"}))
+	for _, entry := range entries {
+		source := ""
+		if entry.SourceFile != nil && entry.SourceLine != nil {
+			source = fmt.Sprintf("%s:%d", *entry.SourceFile, *entry.SourceLine)
+		}
+		fatalOnError(writer.Write([]string{entry.UUID, entry.Action, nullable(entry.OldValue), nullable(entry.NewValue), source}))
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
+	tables["audit.csv"] = buf.String()
+	return tables
+}
+
+// goldenReports - report CSVs written by import into a given directory, golden file name -> contents
+func goldenReports(dir string) (map[string]string, error) {
+	reports := make(map[string]string)
+	for _, report := range gGoldenReports {
+		fileNames, err := filepath.Glob(filepath.Join(dir, report[0]+"*.csv"))
+		if err != nil {
+			return nil, err
+		}
+		if len(fileNames) == 0 {
+			continue
+		}
+		if len(fileNames) > 1 {
+			return nil, fmt.Errorf("more than one %s report: %v", report[1], fileNames)
+		}
+		data, err := ioutil.ReadFile(fileNames[0])
+		if err != nil {
+			return nil, err
+		}
+		reports[report[1]] = string(data)
+	}
+	return reports, nil
+}
+
+// diffLines - lines missing in actual (prefixed with "-") and unexpected lines in actual (prefixed with "+")
+// rows of golden files are sorted, so this is enough to see what changed
+func diffLines(expected, actual string) (diff []string) {
+	counts := make(map[string]int)
+	for _, line := range strings.Split(actual, "\n") {
+		counts[line]++
+	}
+	for _, line := range strings.Split(expected, "\n") {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		diff = append(diff, "-"+line)
+	}
+	for _, line := range strings.Split(actual, "\n") {
+		if counts[line] > 0 {
+			counts[line]--
+			diff = append(diff, "+"+line)
+		}
+	}
+	return
+}
+
+// runGoldenMode - runs import of a golden case in a given mode in a scratch directory, returns golden files
+func runGoldenMode(caseDir, workDir string, env map[string]string) (map[string]string, error) {
+	st, err := loadGoldenSeed(filepath.Join(caseDir, cGoldenSeed))
+	if err != nil {
+		return nil, err
+	}
+	// import is run on a copy, so sources in reports and audit are "identities.yaml:line"
+	data, err := ioutil.ReadFile(filepath.Join(caseDir, cGoldenInput))
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(workDir, cGoldenInput), data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = importIsolated(workDir, env, st, []string{cGoldenInput})
+	if err != nil {
+		return nil, err
+	}
+	files := goldenTables(st)
+	reports, err := goldenReports(workDir)
+	if err != nil {
+		return nil, err
+	}
+	for name, contents := range reports {
+		files[name] = contents
+	}
+	return files, nil
+}
+
+// checkGoldenFiles - compares actual files with the expected ones, a missing expected file means the file is not produced
+func checkGoldenFiles(expectedDir string, actual map[string]string) (diffs []string, err error) {
+	expected := make(map[string]string)
+	fileNames, err := filepath.Glob(filepath.Join(expectedDir, "*.csv"))
+	if err != nil {
+		return
+	}
+	for _, fileName := range fileNames {
+		var data []byte
+		data, err = ioutil.ReadFile(fileName)
+		if err != nil {
+			return
+		}
+		expected[filepath.Base(fileName)] = string(data)
+	}
+	all := make(map[string]struct{})
+	for name := range expected {
+		all[name] = struct{}{}
+	}
+	for name := range actual {
+		all[name] = struct{}{}
+	}
+	for _, name := range sortedKeys(all) {
+		if expected[name] == actual[name] {
+			continue
+		}
+		diffs = append(diffs, "--- "+filepath.Join(expectedDir, name))
+		for _, line := range diffLines(expected[name], actual[name]) {
+			diffs = append(diffs, "  "+line)
+		}
+	}
+	return
+}
+
+// updateGoldenFiles - replaces expected files with actual ones
+func updateGoldenFiles(expectedDir string, actual map[string]string) error {
+	fileNames, err := filepath.Glob(filepath.Join(expectedDir, "*.csv"))
+	if err != nil {
+		return err
+	}
+	for _, fileName := range fileNames {
+		err = os.Remove(fileName)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.MkdirAll(expectedDir, 0755)
+	if err != nil {
+		return err
+	}
+	for name, contents := range actual {
+		err = ioutil.WriteFile(filepath.Join(expectedDir, name), []byte(contents), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goldenCases - case directories: given directories containing identities.yaml or their subdirectories that do
+func goldenCases(dirs []string) (cases []string, err error) {
+	for _, dir := range dirs {
+		_, err = os.Stat(filepath.Join(dir, cGoldenInput))
+		if err == nil {
+			cases = append(cases, dir)
+			continue
+		}
+		var fileNames []string
+		fileNames, err = filepath.Glob(filepath.Join(dir, "*", cGoldenInput))
+		if err != nil {
+			return
+		}
+		if len(fileNames) == 0 {
+			err = fmt.Errorf("%s: no golden cases found", dir)
+			return
+		}
+		sort.Strings(fileNames)
+		for _, fileName := range fileNames {
+			cases = append(cases, filepath.Dir(fileName))
+		}
+	}
+	err = nil
+	return
+}
+
+// TestGolden - runs golden cases in all modes (dry, compare, replace) against in-memory SortingHat and diffs results
+// with expected files, GOLDEN_UPDATE=1 (re)writes expected files instead
+func TestGolden(t *testing.T) {
+	update := os.Getenv("GOLDEN_UPDATE") != ""
+	cases, err := goldenCases([]string{cGoldenDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, caseDir := range cases {
+		config := make(map[string]string)
+		_, err = os.Stat(filepath.Join(caseDir, cGoldenConfig))
+		if err == nil {
+			config = readConfigFile(filepath.Join(caseDir, cGoldenConfig))
+		}
+		_, err = os.Stat(filepath.Join(caseDir, cGoldenOrgsMap))
+		if err == nil {
+			// import runs in a scratch directory
+			config["ORGS_MAP_FILE"], err = filepath.Abs(filepath.Join(caseDir, cGoldenOrgsMap))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, mode := range gGoldenModes {
+			env := make(map[string]string)
+			for k, v := range config {
+				env[k] = v
+			}
+			for k, v := range mode.env {
+				env[k] = v
+			}
+			caseDir, mode := caseDir, mode
+			t.Run(filepath.Base(caseDir)+"/"+mode.name, func(t *testing.T) {
+				expectedDir := filepath.Join(caseDir, cGoldenExpected, mode.name)
+				actual, err := runGoldenMode(caseDir, t.TempDir(), env)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if update {
+					err = updateGoldenFiles(expectedDir, actual)
+					if err != nil {
+						t.Fatal(err)
+					}
+					t.Logf("updated %s", expectedDir)
+					return
+				}
+				diffs, err := checkGoldenFiles(expectedDir, actual)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(diffs) > 0 {
+					t.Errorf("if changes are expected rerun with GOLDEN_UPDATE=1 and review the diff\n%s", strings.Join(diffs, "\n"))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cGraphQLPageSize - page size used for SortingHat GraphQL API queries
+const cGraphQLPageSize = 100
+
+// SortingHat 0.7+ GraphQL API operations used by import, the test mock (graphql_mock_test.go) dispatches on operation names
+const (
+	cGQLTokenAuth = `mutation tokenAuth($username: String!, $password: String!) {
+  tokenAuth(username: $username, password: $password) { token }
+}`
+	cGQLIndividuals = `query individuals($filters: IdentityFilterType, $page: Int, $pageSize: Int) {
+  individuals(filters: $filters, page: $page, pageSize: $pageSize) {
+    entities {
+      mk
+      profile { name email gender isBot country { code } }
+      identities { uuid name email username source }
+      enrollments { start end organization { id name } }
+    }
+    pageInfo { page numPages hasNext }
+  }
+}`
+	cGQLOrganizations = `query organizations($page: Int, $pageSize: Int) {
+  organizations(page: $page, pageSize: $pageSize) {
+    entities { id name }
+    pageInfo { page numPages hasNext }
+  }
+}`
+	cGQLEnroll = `mutation enroll($uuid: String!, $organization: String!, $fromDate: DateTime, $toDate: DateTime) {
+  enroll(uuid: $uuid, organization: $organization, fromDate: $fromDate, toDate: $toDate) { uuid }
+}`
+	cGQLUpdateProfile = `mutation updateProfile($uuid: String!, $data: ProfileInputType!) {
+  updateProfile(uuid: $uuid, data: $data) { uuid }
+}`
+	cGQLWithdraw = `mutation withdraw($uuid: String!, $organization: String!, $fromDate: DateTime, $toDate: DateTime) {
+  withdraw(uuid: $uuid, organization: $organization, fromDate: $fromDate, toDate: $toDate) { uuid }
+}`
+)
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+type gqlPageInfo struct {
+	Page     int  `json:"page"`
+	NumPages int  `json:"numPages"`
+	HasNext  bool `json:"hasNext"`
+}
+
+type gqlIndividual struct {
+	Mk      string `json:"mk"`
+	Profile *struct {
+		Name    *string `json:"name"`
+		Email   *string `json:"email"`
+		Gender  *string `json:"gender"`
+		IsBot   *bool   `json:"isBot"`
+		Country *struct {
+			Code string `json:"code"`
+		} `json:"country"`
+	} `json:"profile"`
+	Identities []struct {
+		UUID     string  `json:"uuid"`
+		Name     *string `json:"name"`
+		Email    *string `json:"email"`
+		Username *string `json:"username"`
+		Source   string  `json:"source"`
+	} `json:"identities"`
+	Enrollments []struct {
+		Start        string `json:"start"`
+		End          string `json:"end"`
+		Organization struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"organization"`
+	} `json:"enrollments"`
+}
+
+type gqlOrganization struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// gqlHTTPError - non 2xx response, server errors are retried
+type gqlHTTPError struct {
+	status int
+	msg    string
+}
+
+func (e *gqlHTTPError) Error() string {
+	return e.msg
+}
+
+// graphqlStorage - SortingHat 0.7+ GraphQL API (SH_GRAPHQL_URL), changes go through SortingHat validation and caches
+// API has no project slugs and no enrollments origins, so it can only be used for global enrollments with OWNERSHIP=all
+// There is no audit table either, audit entries are appended to SH_GRAPHQL_AUDIT_FILE (JSON lines)
+type graphqlStorage struct {
+	url       string
+	token     string
+	client    *http.Client
+	auditFile string
+	mtx       *sync.Mutex
+	orgs      map[int]string
+	// enrollments have no ids in the API, ids are assigned to fetched ones so they can be withdrawn later
+	rols   map[int]shEnrollment
+	nextID int
+}
+
+// newGraphQLStorage - SH_GRAPHQL_TOKEN is used as JWT token, otherwise token is obtained via tokenAuth
+// using SH_GRAPHQL_USER and SH_GRAPHQL_PASS, SH_GRAPHQL_TIMEOUT is a single request timeout (default 30s)
+func newGraphQLStorage(url string) (*graphqlStorage, error) {
+	s := &graphqlStorage{
+		url:       url,
+		token:     os.Getenv("SH_GRAPHQL_TOKEN"),
+		client:    &http.Client{Timeout: getEnvDuration("SH_GRAPHQL_TIMEOUT", 30*time.Second)},
+		auditFile: os.Getenv("SH_GRAPHQL_AUDIT_FILE"),
+		mtx:       &sync.Mutex{},
+		orgs:      make(map[int]string),
+		rols:      make(map[int]shEnrollment),
+	}
+	if s.auditFile == "" {
+		s.auditFile = cAuditTable + ".jsonl"
+	}
+	if s.token == "" && os.Getenv("SH_GRAPHQL_USER") != "" {
+		var data struct {
+			TokenAuth struct {
+				Token string `json:"token"`
+			} `json:"tokenAuth"`
+		}
+		err := s.call("tokenAuth", cGQLTokenAuth, map[string]interface{}{"username": os.Getenv("SH_GRAPHQL_USER"), "password": os.Getenv("SH_GRAPHQL_PASS")}, &data)
+		if err != nil {
+			return nil, err
+		}
+		s.token = data.TokenAuth.Token
+	}
+	return s, nil
+}
+
+// call - runs GraphQL operation and decodes its data into result, retryable errors are retried (see withRetry)
+// mutations are only retried when the request never reached the server (see withWriteRetry)
+func (s *graphqlStorage) call(operation, query string, variables map[string]interface{}, result interface{}) error {
+	body, err := json.Marshal(gqlRequest{Query: query, OperationName: operation, Variables: variables})
+	if err != nil {
+		return err
+	}
+	var resp gqlResponse
+	withRetries := withRetry
+	if strings.HasPrefix(query, "mutation") {
+		withRetries = withWriteRetry
+	}
+	err = withRetries(operation, func() error {
+		req, e := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+		if e != nil {
+			return e
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.token != "" {
+			req.Header.Set("Authorization", "JWT "+s.token)
+		}
+		r, e := s.client.Do(req)
+		if e != nil {
+			return e
+		}
+		defer func() { _ = r.Body.Close() }()
+		data, e := ioutil.ReadAll(r.Body)
+		if e != nil {
+			return e
+		}
+		if r.StatusCode < 200 || r.StatusCode >= 300 {
+			return &gqlHTTPError{status: r.StatusCode, msg: fmt.Sprintf("graphql %s: %s: %s", operation, r.Status, strings.TrimSpace(string(data)))}
+		}
+		resp = gqlResponse{}
+		return json.Unmarshal(data, &resp)
+	})
+	if err != nil {
+		queryOut(err, operation, fmt.Sprintf("%v", variables))
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		msgs := []string{}
+		for _, e := range resp.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		err = fmt.Errorf("graphql %s: %s", operation, strings.Join(msgs, "; "))
+	}
+	queryOut(err, operation, fmt.Sprintf("%v", variables))
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Data, result)
+}
+
+// individuals - calls f for individuals matching filters page by page, until f returns false or there are no more pages
+func (s *graphqlStorage) individuals(filters map[string]interface{}, f func(*gqlIndividual) bool) error {
+	for page := 1; ; page++ {
+		var data struct {
+			Individuals struct {
+				Entities []gqlIndividual `json:"entities"`
+				PageInfo gqlPageInfo     `json:"pageInfo"`
+			} `json:"individuals"`
+		}
+		err := s.call("individuals", cGQLIndividuals, map[string]interface{}{"filters": filters, "page": page, "pageSize": cGraphQLPageSize}, &data)
+		if err != nil {
+			return err
+		}
+		for i := range data.Individuals.Entities {
+			if !f(&data.Individuals.Entities[i]) {
+				return nil
+			}
+		}
+		if !data.Individuals.PageInfo.HasNext {
+			return nil
+		}
+	}
+}
+
+// individual - returns nil when there is no individual with a given uuid
+func (s *graphqlStorage) individual(uuid string) (individual *gqlIndividual, err error) {
+	err = s.individuals(map[string]interface{}{"uuid": uuid}, func(i *gqlIndividual) bool {
+		if i.Mk == uuid {
+			individual = i
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func (s *graphqlStorage) setOrigin(origin string) error {
+	return nil
+}
+
+func (s *graphqlStorage) profileUUIDs(name string) ([]string, error) {
+	uuids := make(map[string]struct{})
+	err := s.individuals(map[string]interface{}{"term": name}, func(i *gqlIndividual) bool {
+		if i.Profile != nil && i.Profile.Name != nil && sameLookupKey(*i.Profile.Name, name) {
+			uuids[i.Mk] = struct{}{}
+		}
+		return len(uuids) < 2
+	})
+	return firstKeys(uuids, 2), err
+}
+
+// identityUUIDs - API only has a "term" filter (name, email or username contains), exact conditions are checked here
+func (s *graphqlStorage) identityUUIDs(q identityQuery) ([]string, error) {
+	term := ""
+	for _, value := range []*string{q.email, q.username, q.name} {
+		if value != nil {
+			term = *value
+			break
+		}
+	}
+	// term search is case insensitive, names, emails and usernames are compared like MariaDB collation does (see lookupKey)
+	same := func(cond, value *string) bool {
+		return cond == nil || (value != nil && sameLookupKey(*value, *cond))
+	}
+	uuids := make(map[string]struct{})
+	err := s.individuals(map[string]interface{}{"term": term}, func(i *gqlIndividual) bool {
+		for _, identity := range i.Identities {
+			source := identity.Source
+			if same(q.name, identity.Name) && same(q.email, identity.Email) && same(q.username, identity.Username) && (q.source == nil || *q.source == source) {
+				uuids[i.Mk] = struct{}{}
+				break
+			}
+		}
+		return len(uuids) < 2
+	})
+	return firstKeys(uuids, 2), err
+}
+
+func (s *graphqlStorage) organizations() (map[int]string, error) {
+	orgs := make(map[int]string)
+	for page := 1; ; page++ {
+		var data struct {
+			Organizations struct {
+				Entities []gqlOrganization `json:"entities"`
+				PageInfo gqlPageInfo       `json:"pageInfo"`
+			} `json:"organizations"`
+		}
+		err := s.call("organizations", cGQLOrganizations, map[string]interface{}{"page": page, "pageSize": cGraphQLPageSize}, &data)
+		if err != nil {
+			return nil, err
+		}
+		for _, org := range data.Organizations.Entities {
+			id, err := strconv.Atoi(org.ID)
+			if err != nil {
+				return nil, fmt.Errorf("organization '%s' has non numeric id '%s'", org.Name, org.ID)
+			}
+			orgs[id] = org.Name
+		}
+		if !data.Organizations.PageInfo.HasNext {
+			break
+		}
+	}
+	s.mtx.Lock()
+	for id, name := range orgs {
+		s.orgs[id] = name
+	}
+	s.mtx.Unlock()
+	return orgs, nil
+}
+
+func (s *graphqlStorage) matchesRegexp(str, re string) (bool, error) {
+	return matchesRegexpCI(str, re)
+}
+
+func (s *graphqlStorage) uidentityExists(uuid string) (bool, error) {
+	individual, err := s.individual(uuid)
+	return individual != nil, err
+}
+
+func (s *graphqlStorage) profile(uuid string) (*shProfile, error) {
+	individual, err := s.individual(uuid)
+	if err != nil || individual == nil || individual.Profile == nil {
+		return nil, err
+	}
+	profile := &shProfile{UUID: uuid, IsBot: individual.Profile.IsBot, Email: individual.Profile.Email, Gender: individual.Profile.Gender}
+	if individual.Profile.Name != nil {
+		profile.Name = *individual.Profile.Name
+	}
+	if individual.Profile.Country != nil {
+		code := individual.Profile.Country.Code
+		profile.CountryCode = &code
+	}
+	return profile, nil
+}
+
+// updateProfile - gender accuracy is set to 100 together with gender (like mysqlStorage.updateProfile)
+func (s *graphqlStorage) updateProfile(profile *shProfile, fields []string) error {
+	data := make(map[string]interface{})
+	for _, name := range fields {
+		switch name {
+		case "email":
+			data["email"] = profile.Email
+		case "gender":
+			data["gender"] = profile.Gender
+			data["genderAcc"] = 100
+		case "country_code":
+			data["countryCode"] = profile.CountryCode
+		case "is_bot":
+			data["isBot"] = profile.IsBot
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return s.call("updateProfile", cGQLUpdateProfile, map[string]interface{}{"uuid": profile.UUID, "data": data}, nil)
+}
+
+func (s *graphqlStorage) identityEmail(uuid, source, username string) (string, bool, error) {
+	individual, err := s.individual(uuid)
+	if err != nil || individual == nil {
+		return "", false, err
+	}
+	for _, identity := range individual.Identities {
+		if identity.Source == source && identity.Username != nil && sameLookupKey(*identity.Username, username) && identity.Email != nil {
+			return *identity.Email, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// gqlTime - API returns ISO 8601 date times
+func gqlTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		dt, err := time.Parse(layout, s)
+		if err == nil {
+			return dt.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse date '%s'", s)
+}
+
+func (s *graphqlStorage) enrollments(uuid string, projectSlug *string, originColumn string) (enrollments []shEnrollment, err error) {
+	if projectSlug != nil {
+		return nil, fmt.Errorf("SortingHat GraphQL API has no project slugs, cannot import into project '%s'", *projectSlug)
+	}
+	if originColumn != "" {
+		return nil, fmt.Errorf("SortingHat GraphQL API has no enrollments origins, use OWNERSHIP=%s", cOwnershipAll)
+	}
+	individual, err := s.individual(uuid)
+	if err != nil || individual == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, rol := range individual.Enrollments {
+		enrollment := shEnrollment{UUID: uuid, Organization: rol.Organization.Name}
+		enrollment.OrgID, err = strconv.Atoi(rol.Organization.ID)
+		if err != nil {
+			return nil, fmt.Errorf("organization '%s' has non numeric id '%s'", rol.Organization.Name, rol.Organization.ID)
+		}
+		enrollment.Start, err = gqlTime(rol.Start)
+		if err != nil {
+			return nil, err
+		}
+		enrollment.End, err = gqlTime(rol.End)
+		if err != nil {
+			return nil, err
+		}
+		s.nextID++
+		enrollment.ID = s.nextID
+		s.rols[enrollment.ID] = enrollment
+		s.orgs[enrollment.OrgID] = rol.Organization.Name
+		enrollments = append(enrollments, enrollment)
+	}
+	return
+}
+
+func (s *graphqlStorage) withdraw(enrollment *shEnrollment) error {
+	return s.call(
+		"withdraw",
+		cGQLWithdraw,
+		map[string]interface{}{
+			"uuid":         enrollment.UUID,
+			"organization": enrollment.Organization,
+			"fromDate":     enrollment.Start.Format(time.RFC3339),
+			"toDate":       enrollment.End.Format(time.RFC3339),
+		},
+		nil,
+	)
+}
+
+func (s *graphqlStorage) deleteEnrollments(uuid string, projectSlug *string) error {
+	enrollments, err := s.enrollments(uuid, projectSlug, "")
+	if err != nil {
+		return err
+	}
+	for i := range enrollments {
+		err = s.withdraw(&enrollments[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *graphqlStorage) deleteEnrollment(id int) error {
+	s.mtx.Lock()
+	enrollment, ok := s.rols[id]
+	s.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("enrollment %d was not fetched", id)
+	}
+	return s.withdraw(&enrollment)
+}
+
+// addEnrollment - enrolls into organization with the SortingHat name (input may use a differently cased or mapped name)
+func (s *graphqlStorage) addEnrollment(enrollment *shEnrollment, projectSlug *string, originColumn, origin string) error {
+	if projectSlug != nil {
+		return fmt.Errorf("SortingHat GraphQL API has no project slugs, cannot import into project '%s'", *projectSlug)
+	}
+	s.mtx.Lock()
+	org, ok := s.orgs[enrollment.OrgID]
+	s.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown organization id %d", enrollment.OrgID)
+	}
+	return s.call(
+		"enroll",
+		cGQLEnroll,
+		map[string]interface{}{
+			"uuid":         enrollment.UUID,
+			"organization": org,
+			"fromDate":     enrollment.Start.Format(time.RFC3339),
+			"toDate":       enrollment.End.Format(time.RFC3339),
+		},
+		nil,
+	)
+}
+
+func (s *graphqlStorage) ensureAuditTable() error {
+	f, err := os.OpenFile(s.auditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *graphqlStorage) addAuditEntry(entry *auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	f, err := os.OpenFile(s.auditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *graphqlStorage) auditEntries(uuid string) (entries []auditEntry, err error) {
+	f, err := os.Open(s.auditFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return
+		}
+		if entry.UUID == uuid {
+			entries = append(entries, entry)
+		}
+	}
+	err = scanner.Err()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DtCreated.Before(entries[j].DtCreated)
+	})
+	return
+}
+
+// schema - API has no schema to inspect
+func (s *graphqlStorage) schema(tables []string) (map[string]*tableSchema, error) {
+	return nil, nil
+}
+
+func (s *graphqlStorage) hasProjectSlugs() bool {
+	return false
+}
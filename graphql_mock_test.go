@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// graphqlMock - local stand-in for SortingHat GraphQL API, serves operations used by graphqlStorage
+// from in-memory SortingHat seeded with golden seed file (see graphql_test.go), it dispatches on operation names only
+type graphqlMock struct {
+	st       *memoryStorage
+	user     string
+	password string
+	token    string
+}
+
+func (m *graphqlMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		req  gqlRequest
+		data interface{}
+		err  error
+	)
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log := gLog.with("operation", req.OperationName)
+	if req.OperationName != "tokenAuth" && m.token != "" && r.Header.Get("Authorization") != "JWT "+m.token {
+		err = fmt.Errorf("authentication credentials were not provided")
+	} else {
+		switch req.OperationName {
+		case "tokenAuth":
+			data, err = m.tokenAuth(req.Variables)
+		case "individuals":
+			data, err = m.individuals(req.Variables)
+		case "organizations":
+			data, err = m.organizations(req.Variables)
+		case "enroll":
+			data, err = m.enroll(req.Variables)
+		case "withdraw":
+			data, err = m.withdraw(req.Variables)
+		case "updateProfile":
+			data, err = m.updateProfile(req.Variables)
+		default:
+			err = fmt.Errorf("unknown operation '%s'", req.OperationName)
+		}
+	}
+	resp := map[string]interface{}{"data": data}
+	if err != nil {
+		log.warn("operation failed", "variables", fmt.Sprintf("%v", req.Variables), "error", err)
+		resp = map[string]interface{}{"data": nil, "errors": []map[string]string{{"message": err.Error()}}}
+	} else {
+		log.debug("operation", "variables", fmt.Sprintf("%v", req.Variables))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func mockString(vars map[string]interface{}, name string) string {
+	s, _ := vars[name].(string)
+	return s
+}
+
+// mockPage - returns [from, to) range of a given page (pages start at 1) and page info
+func mockPage(vars map[string]interface{}, n int) (int, int, gqlPageInfo) {
+	page, pageSize := 1, cGraphQLPageSize
+	if v, ok := vars["page"].(float64); ok && v > 0 {
+		page = int(v)
+	}
+	if v, ok := vars["pageSize"].(float64); ok && v > 0 {
+		pageSize = int(v)
+	}
+	from, to := (page-1)*pageSize, page*pageSize
+	if from > n {
+		from = n
+	}
+	if to > n {
+		to = n
+	}
+	return from, to, gqlPageInfo{Page: page, NumPages: (n + pageSize - 1) / pageSize, HasNext: to < n}
+}
+
+func (m *graphqlMock) tokenAuth(vars map[string]interface{}) (interface{}, error) {
+	if m.user != "" && (mockString(vars, "username") != m.user || mockString(vars, "password") != m.password) {
+		return nil, fmt.Errorf("please enter valid credentials")
+	}
+	return map[string]interface{}{"tokenAuth": map[string]string{"token": m.token}}, nil
+}
+
+func containsFold(s *string, term string) bool {
+	return s != nil && strings.Contains(strings.ToLower(*s), term)
+}
+
+func (m *graphqlMock) individuals(vars map[string]interface{}) (interface{}, error) {
+	filters, _ := vars["filters"].(map[string]interface{})
+	uuid, term := mockString(filters, "uuid"), strings.ToLower(mockString(filters, "term"))
+	m.st.mtx.Lock()
+	defer m.st.mtx.Unlock()
+	uuids := []string{}
+	for _, u := range sortedKeys(m.st.uidentities) {
+		if uuid != "" && u != uuid {
+			continue
+		}
+		if term != "" {
+			profile := m.st.profiles[u]
+			match := containsFold(&profile.Name, term)
+			for _, identity := range m.st.identities {
+				if identity.uuid == u && (containsFold(&identity.name, term) || containsFold(identity.email, term) || containsFold(&identity.username, term)) {
+					match = true
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		uuids = append(uuids, u)
+	}
+	from, to, pageInfo := mockPage(vars, len(uuids))
+	entities := []map[string]interface{}{}
+	for _, u := range uuids[from:to] {
+		profile := m.st.profiles[u]
+		identities := []map[string]interface{}{}
+		for _, identity := range m.st.identities {
+			if identity.uuid != u {
+				continue
+			}
+			identities = append(identities, map[string]interface{}{"uuid": u, "name": identity.name, "email": identity.email, "username": identity.username, "source": identity.source})
+		}
+		enrollments := []map[string]interface{}{}
+		for _, rol := range m.st.rols {
+			// API has no project slugs
+			if rol.UUID != u || rol.ProjectSlug != nil {
+				continue
+			}
+			enrollments = append(enrollments, map[string]interface{}{
+				"start":        rol.Start.Format(time.RFC3339),
+				"end":          rol.End.Format(time.RFC3339),
+				"organization": map[string]string{"id": strconv.Itoa(rol.OrgID), "name": m.st.orgs[rol.OrgID]},
+			})
+		}
+		entities = append(entities, map[string]interface{}{
+			"mk":          u,
+			"profile":     mockProfile(&profile),
+			"identities":  identities,
+			"enrollments": enrollments,
+		})
+	}
+	return map[string]interface{}{"individuals": map[string]interface{}{"entities": entities, "pageInfo": pageInfo}}, nil
+}
+
+func (m *graphqlMock) organizations(vars map[string]interface{}) (interface{}, error) {
+	m.st.mtx.Lock()
+	defer m.st.mtx.Unlock()
+	ids := []int{}
+	for id := range m.st.orgs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	from, to, pageInfo := mockPage(vars, len(ids))
+	entities := []gqlOrganization{}
+	for _, id := range ids[from:to] {
+		entities = append(entities, gqlOrganization{ID: strconv.Itoa(id), Name: m.st.orgs[id]})
+	}
+	return map[string]interface{}{"organizations": map[string]interface{}{"entities": entities, "pageInfo": pageInfo}}, nil
+}
+
+// mockEnrollment - parses uuid, organization and period variables of enroll/withdraw mutations
+func (m *graphqlMock) mockEnrollment(vars map[string]interface{}) (enrollment shEnrollment, err error) {
+	enrollment = shEnrollment{UUID: mockString(vars, "uuid"), Organization: mockString(vars, "organization"), Start: gDefaultStartDate, End: gDefaultEndDate}
+	if s := mockString(vars, "fromDate"); s != "" {
+		enrollment.Start, err = gqlTime(s)
+		if err != nil {
+			return
+		}
+	}
+	if s := mockString(vars, "toDate"); s != "" {
+		enrollment.End, err = gqlTime(s)
+		if err != nil {
+			return
+		}
+	}
+	if _, ok := m.st.uidentities[enrollment.UUID]; !ok {
+		err = fmt.Errorf("%s not found in the registry", enrollment.UUID)
+		return
+	}
+	for id, name := range m.st.orgs {
+		if name == enrollment.Organization {
+			enrollment.OrgID = id
+			return
+		}
+	}
+	err = fmt.Errorf("%s not found in the registry", enrollment.Organization)
+	return
+}
+
+func (m *graphqlMock) enroll(vars map[string]interface{}) (interface{}, error) {
+	m.st.mtx.Lock()
+	defer m.st.mtx.Unlock()
+	enrollment, err := m.mockEnrollment(vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, rol := range m.st.rols {
+		if rol.UUID == enrollment.UUID && rol.OrgID == enrollment.OrgID && rol.ProjectSlug == nil && rol.Start.Before(enrollment.End) && enrollment.Start.Before(rol.End) {
+			return nil, fmt.Errorf("period '%s' - '%s' of %s enrollment in %s overlaps an existing one", toYMDDate(enrollment.Start), toYMDDate(enrollment.End), enrollment.UUID, enrollment.Organization)
+		}
+	}
+	m.st.nextID++
+	enrollment.ID = m.st.nextID
+	enrollment.Organization = ""
+	m.st.rols = append(m.st.rols, enrollment)
+	gLog.info("enrolled", "uuid", enrollment.UUID, "organization", m.st.orgs[enrollment.OrgID], "start", toYMDDate(enrollment.Start), "end", toYMDDate(enrollment.End))
+	return map[string]interface{}{"enroll": map[string]string{"uuid": enrollment.UUID}}, nil
+}
+
+// withdraw - removes enrollments in organization that are within a given period
+func (m *graphqlMock) withdraw(vars map[string]interface{}) (interface{}, error) {
+	m.st.mtx.Lock()
+	defer m.st.mtx.Unlock()
+	enrollment, err := m.mockEnrollment(vars)
+	if err != nil {
+		return nil, err
+	}
+	rols := []shEnrollment{}
+	for _, rol := range m.st.rols {
+		if rol.UUID == enrollment.UUID && rol.OrgID == enrollment.OrgID && rol.ProjectSlug == nil && !rol.Start.Before(enrollment.Start) && !rol.End.After(enrollment.End) {
+			continue
+		}
+		rols = append(rols, rol)
+	}
+	if len(rols) == len(m.st.rols) {
+		return nil, fmt.Errorf("enrollment of %s in %s not found in the registry", enrollment.UUID, enrollment.Organization)
+	}
+	m.st.rols = rols
+	gLog.info("withdrawn", "uuid", enrollment.UUID, "organization", enrollment.Organization, "start", toYMDDate(enrollment.Start), "end", toYMDDate(enrollment.End))
+	return map[string]interface{}{"withdraw": map[string]string{"uuid": enrollment.UUID}}, nil
+}
+
+func mockProfile(profile *shProfile) map[string]interface{} {
+	data := map[string]interface{}{"name": profile.Name, "email": profile.Email, "gender": profile.Gender, "isBot": profile.IsBot, "country": nil}
+	if profile.CountryCode != nil {
+		data["country"] = map[string]string{"code": *profile.CountryCode}
+	}
+	return data
+}
+
+// updateProfile - updates fields given in data, null values clear them
+func (m *graphqlMock) updateProfile(vars map[string]interface{}) (interface{}, error) {
+	uuid := mockString(vars, "uuid")
+	data, _ := vars["data"].(map[string]interface{})
+	profile := shProfile{UUID: uuid}
+	fields := []string{}
+	optional := func(key string) *string {
+		s, ok := data[key].(string)
+		if !ok {
+			return nil
+		}
+		return &s
+	}
+	for key, name := range map[string]string{"email": "email", "gender": "gender", "countryCode": "country_code", "isBot": "is_bot"} {
+		if _, ok := data[key]; !ok {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	profile.Email, profile.Gender, profile.CountryCode = optional("email"), optional("gender"), optional("countryCode")
+	if v, ok := data["isBot"].(bool); ok {
+		profile.IsBot = &v
+	}
+	if profile.CountryCode != nil && !isCountryCode(*profile.CountryCode) {
+		return nil, fmt.Errorf("country code '%s' not found in the registry", *profile.CountryCode)
+	}
+	err := m.st.updateProfile(&profile, fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found in the registry", uuid)
+	}
+	gLog.info("profile updated", "uuid", uuid, "fields", strings.Join(fields, ","))
+	return map[string]interface{}{"updateProfile": map[string]string{"uuid": uuid}}, nil
+}
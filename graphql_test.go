@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGraphQLImport - import via graphqlStorage against SortingHat GraphQL API mock seeded with matching golden case seed
+func TestGraphQLImport(t *testing.T) {
+	cases := []struct {
+		name  string
+		env   map[string]string
+		token string
+		input string
+		fails bool
+		uuid  string
+		rols  []string
+	}{
+		{
+			name:  "match by name and enroll",
+			token: "secret",
+			input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+			uuid: "u1",
+			rols: []string{"Company A/(nil)/null"},
+		},
+		{
+			name:  "name lookup is case insensitive",
+			token: "secret",
+			input: `
+- profile:
+    name: john doe
+  enrollments:
+  - organization: Company B
+`,
+			uuid: "u1",
+			rols: []string{"Company B/(nil)/null"},
+		},
+		{
+			name:  "replace withdraws different enrollments",
+			env:   map[string]string{"COMPARE": "1", "REPLACE": "1"},
+			token: "secret",
+			input: `
+- profile:
+    name: Mary Major
+  enrollments:
+  - organization: Company A
+    end: 2018-01-01
+  - organization: Company C
+    start: 2018-01-01
+`,
+			uuid: "u5",
+			rols: []string{"Company A/(nil)/null", "Company C/(nil)/null"},
+		},
+		{
+			name:  "project slugs are rejected before any change",
+			token: "secret",
+			input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+- profile:
+    name: Mary Major
+  enrollments:
+  - organization: Company C
+    project_slug: finos-f
+`,
+			fails: true,
+			uuid:  "u1",
+		},
+		{
+			name:  "invalid token",
+			token: "invalid",
+			input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+			fails: true,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			st, err := loadGoldenSeed(filepath.Join(cGoldenDir, "matching", cGoldenSeed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := httptest.NewServer(&graphqlMock{st: st, token: "secret"})
+			defer server.Close()
+			store, err := newGraphQLStorage(server.URL + "/api/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.token = tc.token
+			dir := t.TempDir()
+			fn := filepath.Join(dir, cGoldenInput)
+			err = ioutil.WriteFile(fn, []byte(strings.TrimLeft(tc.input, "\n")), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = importIsolated(dir, tc.env, store, []string{fn})
+			if tc.fails {
+				if err == nil {
+					t.Fatal("import should fail")
+				}
+				if tc.uuid != "" {
+					err = expectEnrollments(st, tc.uuid, tc.rols...)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = expectEnrollments(st, tc.uuid, tc.rols...)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
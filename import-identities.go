@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"runtime/debug"
@@ -16,18 +19,20 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"golang.org/x/text/transform"
-	"golang.org/x/text/unicode/norm"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	cOrigin = "import-finos-identities"
-	nils    = "(nil)"
+	cOrigin             = "import-finos-identities"
+	nils                = "(nil)"
+	cOwnershipAll       = "all"
+	cOwnershipOwn       = "own"
+	cOwnershipRank      = "precedence"
+	cResolutionKept     = "kept"
+	cResolutionReplaced = "replaced"
 )
 
 var (
-	gDebugSQL         bool
 	gProjectSlug      *string
 	gDefaultStartDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
 	gDefaultEndDate   = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -38,17 +43,24 @@ type shData struct {
 }
 
 type shUIdentity struct {
-	Profile     shProfile      `yaml:"profile"`
-	Enrollments []shEnrollment `yaml:"enrollments"`
-	Emails      []string       `yaml:"email"`
-	UUID        string
-	Idents      map[string][]string
+	Profile      shProfile      `yaml:"profile"`
+	Enrollments  []shEnrollment `yaml:"enrollments"`
+	Emails       []string       `yaml:"email"`
+	ProjectSlug  *string        `yaml:"project_slug"`
+	UUID         string
+	Idents       map[string][]string
+	SourceFile   string `yaml:"-"`
+	SourceLine   int    `yaml:"-"`
+	SourceRecord string `yaml:"-"`
 }
 
 type shProfile struct {
-	Name  string `json:"name"`
-	IsBot *bool  `json:"is_bot"`
-	UUID  string
+	Name        string  `json:"name"`
+	Email       *string `json:"email" yaml:"email"`
+	Gender      *string `json:"gender" yaml:"gender"`
+	CountryCode *string `json:"country_code" yaml:"country_code"`
+	IsBot       *bool   `json:"is_bot" yaml:"is_bot"`
+	UUID        string
 }
 
 type shEnrollment struct {
@@ -57,32 +69,52 @@ type shEnrollment struct {
 	End          time.Time `json:"end"`
 	UUID         string
 	OrgID        int
-	ProjectSlug  *string
+	ProjectSlug  *string `yaml:"project_slug"`
+	ID           int     `yaml:"-"`
+	Origin       *string `yaml:"-"`
 }
 
 type allMappings struct {
 	Mappings [][2]string `yaml:"mappings"`
 }
 
-type importStats struct {
-	uidentitiesFound    int
-	uidentitiesNotFound int
-	profilesFound       int
-	profilesSame        int
-	identitiesFound     int
-	identitiesSame      int
-	enrollmentsFound    int
-	enrollmentsAdded    int
-	enrollmentsSame     int
-	enrollmentsSkipped  int
-	enrollmentsDeleted  int
+type projectsManifest struct {
+	Files []manifestFile `yaml:"files"`
+}
+
+type manifestFile struct {
+	File         string    `yaml:"file"`
+	ProjectSlugs []*string `yaml:"project_slugs"`
+}
+
+// ownershipPolicy - decides which existing enrollments import can replace
+// "all" - import owns all enrollments (legacy mode, origins are not checked)
+// "own" - import only replaces enrollments it created, enrollments from other origins take precedence
+// "precedence" - ORIGINS_PRECEDENCE lists origins from the most important, unlisted origins come last
+type ownershipPolicy struct {
+	mode      string
+	column    string
+	ranks     map[string]int
+	ownRank   int
+	mtx       *sync.Mutex
+	conflicts []originConflict
+}
+
+type originConflict struct {
+	enrollment shEnrollment
+	imported   []shEnrollment
+	resolution string
+	source     string
 }
 
 func fatalOnError(err error) {
 	if err != nil {
 		tm := time.Now()
-		fmt.Printf("Error(time=%+v):\nError: '%s'\nStacktrace:\n%s\n", tm, err.Error(), string(debug.Stack()))
+		gLog.error("fatal error", "error", err, "stacktrace", string(debug.Stack()))
 		fmt.Fprintf(os.Stderr, "Error(time=%+v):\nError: '%s'\nStacktrace:\n", tm, err.Error())
+		gSummary.addError(err)
+		// unrecovered panic exits with code 2
+		reportRun(cStatusFailed, 2)
 		panic("stacktrace")
 	}
 }
@@ -93,6 +125,7 @@ func fatalf(f string, a ...interface{}) {
 
 func (p *shProfile) String() (s string) {
 	s = "{UUID:" + p.UUID + ",Name:" + p.Name
+	s += ",Email:" + strOrNil(p.Email) + ",Gender:" + strOrNil(p.Gender) + ",CountryCode:" + strOrNil(p.CountryCode)
 	s += ",IsBot:"
 	if p.IsBot != nil {
 		s += fmt.Sprintf("%v}", *p.IsBot)
@@ -112,6 +145,14 @@ func (e *shEnrollment) String() (s string) {
 	return
 }
 
+// source - returns file:line where identity was defined
+func (u *shUIdentity) source() string {
+	if u.SourceFile == "" {
+		return nils
+	}
+	return fmt.Sprintf("%s:%d", u.SourceFile, u.SourceLine)
+}
+
 func (u *shUIdentity) String() string {
 	rols := "["
 	for _, rol := range u.Enrollments {
@@ -122,43 +163,62 @@ func (u *shUIdentity) String() string {
 	} else {
 		rols = "[]"
 	}
-	return fmt.Sprintf("{UUID:%s,Profile:%s,Emails:%v,Enrollments:%s,Idents:%v}", u.UUID, u.Profile.String(), u.Emails, rols, u.Idents)
+	return fmt.Sprintf("{UUID:%s,Profile:%s,Emails:%v,Enrollments:%s,Idents:%v,Source:%s}", u.UUID, u.Profile.String(), u.Emails, rols, u.Idents, u.source())
 }
 
-func queryOut(query string, args ...interface{}) {
-	fmt.Printf("%s\n", query)
-	if len(args) > 0 {
-		s := ""
-		for vi, vv := range args {
-			switch v := vv.(type) {
-			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, complex64, complex128, string, bool, time.Time:
-				s += fmt.Sprintf("%d:%+v ", vi+1, v)
-			case *int, *int8, *int16, *int32, *int64, *uint, *uint8, *uint16, *uint32, *uint64, *float32, *float64, *complex64, *complex128, *string, *bool, *time.Time:
-				s += fmt.Sprintf("%d:%+v ", vi+1, v)
-			case nil:
+func queryArgs(args ...interface{}) string {
+	s := ""
+	for vi, vv := range args {
+		switch v := vv.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, complex64, complex128, string, bool, time.Time:
+			s += fmt.Sprintf("%d:%+v ", vi+1, v)
+		case *int, *int8, *int16, *int32, *int64, *uint, *uint8, *uint16, *uint32, *uint64, *float32, *float64, *complex64, *complex128, *string, *bool, *time.Time:
+			rv := reflect.ValueOf(v)
+			if rv.IsNil() {
 				s += fmt.Sprintf("%d:(null) ", vi+1)
-			default:
-				s += fmt.Sprintf("%d:%+v ", vi+1, reflect.ValueOf(vv).Elem())
+				continue
 			}
+			s += fmt.Sprintf("%d:%+v ", vi+1, rv.Elem())
+		case nil:
+			s += fmt.Sprintf("%d:(null) ", vi+1)
+		default:
+			s += fmt.Sprintf("%d:%+v ", vi+1, reflect.ValueOf(vv).Elem())
 		}
-		fmt.Printf("[%s]\n", s)
 	}
+	return strings.TrimSpace(s)
 }
 
-func query(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
-	rows, err := db.Query(query, args...)
-	if err != nil || gDebugSQL {
-		queryOut(query, args...)
+// queryOut - logs query with its arguments, failed queries are logged as errors, others at SQL log level
+func queryOut(err error, query string, args ...interface{}) {
+	if err != nil {
+		gLog.error("query failed", "sql", query, "args", queryArgs(args...), "error", err)
+		return
+	}
+	if gLog.enabled(cLevelSQL) {
+		gLog.sql("query", "sql", query, "args", queryArgs(args...))
 	}
+}
+
+func query(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := withRetry(query, func() (e error) {
+		rows, e = db.Query(query, args...)
+		return
+	})
+	queryOut(err, query, args...)
 	return rows, err
 }
 
 func exec(db *sql.DB, skip, query string, args ...interface{}) (sql.Result, error) {
-	res, err := db.Exec(query, args...)
-	if err != nil || gDebugSQL {
-		if skip == "" || !strings.Contains(err.Error(), skip) || gDebugSQL {
-			queryOut(query, args...)
-		}
+	var res sql.Result
+	err := withWriteRetry(query, func() (e error) {
+		res, e = db.Exec(query, args...)
+		return
+	})
+	if err != nil && skip != "" && strings.Contains(err.Error(), skip) {
+		queryOut(nil, query, args...)
+	} else {
+		queryOut(err, query, args...)
 	}
 	return res, err
 }
@@ -193,274 +253,324 @@ func toYMDDate(dt time.Time) string {
 	return fmt.Sprintf("%04d-%02d-%02d", dt.Year(), dt.Month(), dt.Day())
 }
 
-func stripUnicode(pStr *string) *string {
-	if pStr == nil {
-		return nil
+func newOwnershipPolicy() (policy *ownershipPolicy) {
+	policy = &ownershipPolicy{
+		mode:   os.Getenv("OWNERSHIP"),
+		column: os.Getenv("ENROLLMENTS_ORIGIN_COLUMN"),
+		ranks:  make(map[string]int),
+		mtx:    &sync.Mutex{},
+	}
+	if policy.mode == "" {
+		policy.mode = cOwnershipAll
+	}
+	if policy.column == "" {
+		policy.column = "origin"
+	}
+	for _, r := range policy.column {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			fatalf("invalid enrollments origin column name: '%s'", policy.column)
+		}
+	}
+	switch policy.mode {
+	case cOwnershipAll:
+		policy.ownRank = 0
+	case cOwnershipOwn:
+		policy.ownRank = 1
+	case cOwnershipRank:
+		origins := strings.Split(os.Getenv("ORIGINS_PRECEDENCE"), ",")
+		for i, origin := range origins {
+			origin = strings.TrimSpace(origin)
+			if origin == "" {
+				continue
+			}
+			policy.ranks[origin] = i
+		}
+		ownRank, ok := policy.ranks[cOrigin]
+		if !ok {
+			fatalf("ORIGINS_PRECEDENCE must contain '%s' when OWNERSHIP=%s", cOrigin, cOwnershipRank)
+		}
+		policy.ownRank = ownRank
+	default:
+		fatalf("unknown OWNERSHIP mode '%s', allowed: %s, %s, %s", policy.mode, cOwnershipAll, cOwnershipOwn, cOwnershipRank)
 	}
-	str := *pStr
-	isOk := func(r rune) bool {
-		return r < 32 || r >= 127
+	return
+}
+
+// rank - lower value means higher precedence, enrollments without origin are ranked as "null" origin
+func (p *ownershipPolicy) rank(origin *string) int {
+	switch p.mode {
+	case cOwnershipAll:
+		return 1
+	case cOwnershipOwn:
+		if origin != nil && *origin == cOrigin {
+			return p.ownRank
+		}
+		return 0
+	}
+	key := "null"
+	if origin != nil {
+		key = *origin
+	}
+	rank, ok := p.ranks[key]
+	if !ok {
+		return len(p.ranks) + 1
+	}
+	return rank
+}
+
+// wins - returns true when existing enrollment from a given origin cannot be replaced by import
+func (p *ownershipPolicy) wins(origin *string) bool {
+	if origin != nil && *origin == cOrigin {
+		return false
 	}
-	t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
-	str, _, _ = transform.String(t, str)
-	return &str
+	return p.rank(origin) < p.ownRank
 }
 
-func stripUnicodeStr(str string) string {
-	isOk := func(r rune) bool {
-		return r < 32 || r >= 127
+func (p *ownershipPolicy) conflict(uidentity shUIdentity, enrollments []shEnrollment, resolution string) {
+	p.mtx.Lock()
+	for _, enrollment := range enrollments {
+		p.conflicts = append(p.conflicts, originConflict{enrollment: enrollment, imported: uidentity.Enrollments, resolution: resolution, source: uidentity.source()})
 	}
-	t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
-	str, _, _ = transform.String(t, str)
-	return str
+	p.mtx.Unlock()
 }
 
-func lookupUIdentity(db *sql.DB, dbg bool, uidentity *shUIdentity) (uuid string) {
-	printf := func(fmts string, args ...interface{}) {
-		if dbg {
-			fmt.Printf(fmts, args...)
+func slugKey(slug *string) string {
+	if slug == nil {
+		return nils
+	}
+	return *slug
+}
+
+func readProjectsManifest(fileName string) (manifest projectsManifest) {
+	if fileName == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(fileName)
+	fatalOnError(err)
+	fatalOnError(yaml.Unmarshal(data, &manifest))
+	for i, file := range manifest.Files {
+		if file.File == "" {
+			fatalf("projects manifest %s: entry #%d without file name", fileName, i+1)
+		}
+		for j, slug := range file.ProjectSlugs {
+			if slug != nil && *slug == "" {
+				manifest.Files[i].ProjectSlugs[j] = nil
+			}
+		}
+	}
+	return
+}
+
+// fileProjectSlugs - returns project slugs that enrollments from a given file should be imported into
+// Manifest entry matches when its file is the same (cleaned) path, base name is only used when no entry has the same path
+// and exactly one entry has the same base name; checkFileNames rejects input files that would share such an entry
+// Falls back to PROJECT_SLUG (or null project slug) when file is not listed in the manifest
+func (m *projectsManifest) fileProjectSlugs(fileName string) []*string {
+	file := m.entry(fileName)
+	if file == nil || len(file.ProjectSlugs) == 0 {
+		return []*string{gProjectSlug}
+	}
+	return file.ProjectSlugs
+}
+
+// entry - returns manifest entry of a given file (nil when file is not listed), fails on ambiguous base names
+func (m *projectsManifest) entry(fileName string) *manifestFile {
+	path := filepath.Clean(fileName)
+	for i := range m.Files {
+		if filepath.Clean(m.Files[i].File) == path {
+			return &m.Files[i]
+		}
+	}
+	var found *manifestFile
+	for i := range m.Files {
+		if filepath.Base(m.Files[i].File) != filepath.Base(path) {
+			continue
+		}
+		if found != nil {
+			fatalf("projects manifest: file %s matches entries %s and %s by base name, use the path as listed in the manifest", fileName, found.File, m.Files[i].File)
 		}
+		found = &m.Files[i]
+	}
+	return found
+}
+
+// checkFileNames - fails when input files with the same base name in different directories would be matched
+// to a manifest entry by base name (they would silently get the same project slugs)
+func (m *projectsManifest) checkFileNames(fileNames []string) {
+	paths := make(map[string]map[string]struct{})
+	for _, fileName := range fileNames {
+		path := filepath.Clean(fileName)
+		base := filepath.Base(path)
+		if paths[base] == nil {
+			paths[base] = make(map[string]struct{})
+		}
+		paths[base][path] = struct{}{}
+	}
+	for _, fileName := range fileNames {
+		path := filepath.Clean(fileName)
+		file := m.entry(path)
+		if file == nil || filepath.Clean(file.File) == path || len(paths[filepath.Base(path)]) < 2 {
+			continue
+		}
+		fatalf("projects manifest: input files %s have the same base name, entry %s only matches one of them by path", strings.Join(sortedKeys(paths[filepath.Base(path)]), ", "), file.File)
 	}
+}
+
+func (m *projectsManifest) fileNames() (fileNames []string) {
+	for _, file := range m.Files {
+		fileNames = append(fileNames, file.File)
+	}
+	return
+}
+
+// lookupUIdentity - finds uuid of a given identity, ambiguous is set when any of the checks matched more than one uuid
+func lookupUIdentity(store shStorage, uidentity *shUIdentity, log *logger) (uuid string, ambiguous bool) {
 	name := uidentity.Profile.Name
-	// by name
-	rows, err := query(db, "select distinct uuid from profiles where name = ?", name)
-	fatalOnError(err)
-	fetched := false
-	multi := false
-	for rows.Next() {
-		fatalOnError(rows.Scan(&uuid))
-		if fetched {
-			multi = true
-			break
+	// check - returns true when exactly one uuid was found
+	check := func(by string, uuids []string, err error, kv ...interface{}) bool {
+		fatalOnError(err)
+		if len(uuids) > 1 {
+			ambiguous = true
 		}
-		fetched = true
+		if len(uuids) == 1 && uuids[0] != "" {
+			uuid = uuids[0]
+			gStats.inc(cPhaseLookup, "found_by_"+strings.Replace(by, "/", "_", -1))
+			log.debug("found", append([]interface{}{"by", by, "uuid", uuid}, kv...)...)
+			return true
+		}
+		log.debug("not found", append([]interface{}{"by", by, "uuids", len(uuids)}, kv...)...)
+		return false
 	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
-	if uuid != "" && fetched && !multi {
-		printf("found by name '%s' -> %s\n", name, uuid)
+	// by name
+	uuids, err := store.profileUUIDs(name)
+	if check("name", uuids, err, "name", name) {
 		return
 	}
-	printf("not found by name '%s' -> (%s,%v,%v)\n", name, uuid, fetched, multi)
 	// by source/username
-	for source, userNames := range uidentity.Idents {
-		for _, userName := range userNames {
-			rows, err := query(db, "select distinct uuid from identities where username = ? and source = ?", userName, source)
-			fatalOnError(err)
-			uuid = ""
-			fetched = false
-			multi = false
-			for rows.Next() {
-				fatalOnError(rows.Scan(&uuid))
-				if fetched {
-					multi = true
-					break
-				}
-				fetched = true
-			}
-			fatalOnError(rows.Err())
-			fatalOnError(rows.Close())
-			if uuid != "" && fetched && !multi {
-				printf("found by source/username '%s/%s' -> %s\n", source, userName, uuid)
+	for _, source := range sortedSources(uidentity.Idents) {
+		source := source
+		for _, userName := range uidentity.Idents[source] {
+			userName := userName
+			uuids, err := store.identityUUIDs(identityQuery{source: &source, username: &userName})
+			if check("source/username", uuids, err, "source_name", source, "username", userName) {
 				return
 			}
-			printf("not found by source/username '%s/%s' -> (%s,%v,%v)\n", source, userName, uuid, fetched, multi)
 		}
-		printf("not found by source/usernames '%s/%v' -> (%s,%v,%v)\n", source, userNames, uuid, fetched, multi)
 	}
 	// by email
 	for _, email := range uidentity.Emails {
-		rows, err := query(db, "select distinct uuid from identities where email = ?", email)
-		fatalOnError(err)
-		uuid = ""
-		fetched = false
-		multi = false
-		for rows.Next() {
-			fatalOnError(rows.Scan(&uuid))
-			if fetched {
-				multi = true
-				break
-			}
-			fetched = true
-		}
-		fatalOnError(rows.Err())
-		fatalOnError(rows.Close())
-		if uuid != "" && fetched && !multi {
-			printf("found by email '%s' -> %s\n", email, uuid)
+		email := email
+		uuids, err := store.identityUUIDs(identityQuery{email: &email})
+		if check("email", uuids, err, "email", email) {
 			return
 		}
-		printf("not found by email '%s' -> (%s,%v,%v)\n", email, uuid, fetched, multi)
 	}
 	// by name & source/username
-	for source, userNames := range uidentity.Idents {
-		for _, userName := range userNames {
-			rows, err := query(db, "select distinct uuid from identities where name = ? and username = ? and source = ?", name, userName, source)
-			fatalOnError(err)
-			uuid = ""
-			fetched = false
-			multi = false
-			for rows.Next() {
-				fatalOnError(rows.Scan(&uuid))
-				if fetched {
-					multi = true
-					break
-				}
-				fetched = true
-			}
-			fatalOnError(rows.Err())
-			fatalOnError(rows.Close())
-			if uuid != "" && fetched && !multi {
-				printf("found by name/source/username '%s/%s/%s' -> %s\n", name, source, userName, uuid)
+	for _, source := range sortedSources(uidentity.Idents) {
+		source := source
+		for _, userName := range uidentity.Idents[source] {
+			userName := userName
+			uuids, err := store.identityUUIDs(identityQuery{name: &name, source: &source, username: &userName})
+			if check("name/source/username", uuids, err, "name", name, "source_name", source, "username", userName) {
 				return
 			}
-			printf("not found by name/source/username '%s/%s/%s' -> (%s,%v,%v)\n", name, source, userName, uuid, fetched, multi)
 		}
-		printf("not found by name/source/usernames '%s/%s/%v' -> (%s,%v,%v)\n", name, source, userNames, uuid, fetched, multi)
 	}
 	// by name & email
 	for _, email := range uidentity.Emails {
-		rows, err := query(db, "select distinct uuid from identities where name = ? and email = ?", name, email)
-		fatalOnError(err)
-		uuid = ""
-		fetched = false
-		multi = false
-		for rows.Next() {
-			fatalOnError(rows.Scan(&uuid))
-			if fetched {
-				multi = true
-				break
-			}
-			fetched = true
-		}
-		fatalOnError(rows.Err())
-		fatalOnError(rows.Close())
-		if uuid != "" && fetched && !multi {
-			printf("found by name/email '%s/%s' -> %s\n", name, email, uuid)
+		email := email
+		uuids, err := store.identityUUIDs(identityQuery{name: &name, email: &email})
+		if check("name/email", uuids, err, "name", name, "email", email) {
 			return
 		}
-		printf("not found by name/email '%s/%s' -> (%s,%v,%v)\n", name, email, uuid, fetched, multi)
 	}
 	// by source/username/email
-	for source, userNames := range uidentity.Idents {
+	for _, source := range sortedSources(uidentity.Idents) {
+		source := source
 		for _, email := range uidentity.Emails {
-			for _, userName := range userNames {
-				rows, err := query(db, "select distinct uuid from identities where username = ? and source = ? and email = ?", userName, source, email)
-				fatalOnError(err)
-				uuid = ""
-				fetched = false
-				multi = false
-				for rows.Next() {
-					fatalOnError(rows.Scan(&uuid))
-					if fetched {
-						multi = true
-						break
-					}
-					fetched = true
-				}
-				fatalOnError(rows.Err())
-				fatalOnError(rows.Close())
-				if uuid != "" && fetched && !multi {
-					printf("found by email/source/username '%s/%s/%s' -> %s\n", email, source, userName, uuid)
+			email := email
+			for _, userName := range uidentity.Idents[source] {
+				userName := userName
+				uuids, err := store.identityUUIDs(identityQuery{email: &email, source: &source, username: &userName})
+				if check("email/source/username", uuids, err, "email", email, "source_name", source, "username", userName) {
 					return
 				}
-				printf("not found by email/source/username '%s/%s/%s' -> (%s,%v,%v)\n", email, source, userName, uuid, fetched, multi)
 			}
-			printf("not found by email/source/usernames '%s/%s/%v' -> (%s,%v,%v)\n", email, source, userNames, uuid, fetched, multi)
 		}
-		printf("not found by emails/source/usernames '%sv/%s/%v' -> (%s,%v,%v)\n", uidentity.Emails, source, userNames, uuid, fetched, multi)
 	}
 	// by name/source/username/email
-	for source, userNames := range uidentity.Idents {
+	for _, source := range sortedSources(uidentity.Idents) {
+		source := source
 		for _, email := range uidentity.Emails {
-			for _, userName := range userNames {
-				rows, err := query(db, "select distinct uuid from identities where username = ? and source = ? and email = ? and name = ?", userName, source, email, name)
-				fatalOnError(err)
-				uuid = ""
-				fetched = false
-				multi = false
-				for rows.Next() {
-					fatalOnError(rows.Scan(&uuid))
-					if fetched {
-						multi = true
-						break
-					}
-					fetched = true
-				}
-				fatalOnError(rows.Err())
-				fatalOnError(rows.Close())
-				if uuid != "" && fetched && !multi {
-					printf("found by name/email/source/username '%s/%s/%s/%s' -> %s\n", name, email, source, userName, uuid)
+			email := email
+			for _, userName := range uidentity.Idents[source] {
+				userName := userName
+				uuids, err := store.identityUUIDs(identityQuery{name: &name, email: &email, source: &source, username: &userName})
+				if check("name/email/source/username", uuids, err, "name", name, "email", email, "source_name", source, "username", userName) {
 					return
 				}
-				printf("not found by name/email/source/username '%s/%s/%s/%s' -> (%s,%v,%v)\n", name, email, source, userName, uuid, fetched, multi)
 			}
-			printf("not found by name/email/source/usernames '%s/%s/%s/%v' -> (%s,%v,%v)\n", name, email, source, userNames, uuid, fetched, multi)
 		}
-		printf("not found by name/emails/source/usernames '%s/%v/%s/%v' -> (%s,%v,%v)\n", name, uidentity.Emails, source, userNames, uuid, fetched, multi)
 	}
 	uuid = ""
 	return
 }
 
-func postprocessIdentities(db *sql.DB, dbg bool, uidentitiesAry []shUIdentity, unknownsAry []interface{}, uidentitiesMap map[string]shUIdentity) (missing []shUIdentity) {
-	fmt.Printf("processing %d profiles\n", len(uidentitiesAry))
+// postprocessIdentities - looks up identities yielded by next as they come, results are processed in input order
+func postprocessIdentities(ctx context.Context, store shStorage, next func() (shUIdentity, bool), uidentitiesMap map[string]shUIdentity, projectSlugs []*string) (missing []shUIdentity, duplicates []mergeConflict) {
+	gLog.info("processing profiles", "phase", cPhaseLookup)
+	// project slug precedence: enrollment's project_slug, then person's project_slug,
+	// then project slugs configured for the file (manifest or PROJECT_SLUG)
+	// empty project_slug in YAML means null project slug
 	setUUID := func(uident *shUIdentity, uid string) {
 		uident.UUID = uid
 		uident.Profile.UUID = uid
-		for i := range uident.Enrollments {
-			uident.Enrollments[i].UUID = uid
-			uident.Enrollments[i].ProjectSlug = gProjectSlug
+		rols := []shEnrollment{}
+		for _, rol := range uident.Enrollments {
+			rol.UUID = uid
+			projectSlug := rol.ProjectSlug
+			if projectSlug == nil {
+				projectSlug = uident.ProjectSlug
+			}
+			if projectSlug != nil {
+				if *projectSlug == "" {
+					projectSlug = nil
+				}
+				rol.ProjectSlug = projectSlug
+				rols = append(rols, rol)
+				continue
+			}
+			for _, projectSlug := range projectSlugs {
+				rol.ProjectSlug = projectSlug
+				rols = append(rols, rol)
+			}
 		}
+		uident.Enrollments = rols
 	}
-	type resultType struct {
-		i    int
-		uuid string
-	}
-	var mtx *sync.Mutex
-	processItem := func(ch chan resultType, idx int, uidentity shUIdentity) (result resultType) {
+	mtx := &sync.Mutex{}
+	out := newOrderedOutput()
+	// results are only collected here, they're processed in input order once all lookups are done
+	// identities not looked up due to cancellation are skipped
+	uidentitiesAry := []shUIdentity{}
+	uuids := []string{}
+	processItem := func(idx int, uidentity shUIdentity) {
 		uuid := ""
-		result.i = idx
 		defer func() {
-			result.uuid = uuid
-			if ch != nil {
-				ch <- result
-			}
+			mtx.Lock()
+			uuids[idx] = uuid
+			mtx.Unlock()
 		}()
+		item := out.logger(idx)
+		defer item.done()
+		log := gLog.with("phase", cPhaseLookup, "source", uidentity.source()).into(item)
 		if uidentity.Profile.Name == "" {
 			fatalf("profile without name: %+v\n", uidentity.String())
 		}
 		if len(uidentity.Enrollments) == 0 {
+			gStats.inc(cPhaseLookup, "skipped_no_enrollments")
 			uuid = "skip"
 			return
 		}
-		iAry, ok := unknownsAry[idx].(map[interface{}]interface{})
-		if !ok {
-			fatalf("cannot parse dynamic datasource identities list fields: %+v\n", uidentity.String())
-		}
-		uidentity.Idents = make(map[string][]string)
-		for ik, iv := range iAry {
-			k, ok := ik.(string)
-			if !ok {
-				fatalf("dynamic datasource identities list - cannot parse key %v,%T as string: %+v\n", ik, ik, uidentity.String())
-			}
-			if k == "profile" || k == "enrollments" || k == "email" {
-				continue
-			}
-			v, ok := iv.([]interface{})
-			if !ok {
-				fatalf("dynamic datasource identities list - cannot parse key %s value %v,%T as array: %+v\n", k, iv, iv, uidentity.String())
-			}
-			others := []string{}
-			for _, it := range v {
-				its, ok := it.(string)
-				if !ok {
-					fatalf("dynamic datasource identities list - cannot parse key %s value %v item %v,%v as string: %+v\n", k, v, it, it, uidentity.String())
-					continue
-				}
-				others = append(others, its)
-			}
-			uidentity.Idents[k] = others
-		}
 		for ei, enrollment := range uidentity.Enrollments {
 			if enrollment.Organization == "" {
 				fatalf("enrollment without organization name: %+v in %+v\n", enrollment.String(), uidentity.String())
@@ -472,136 +582,261 @@ func postprocessIdentities(db *sql.DB, dbg bool, uidentitiesAry []shUIdentity, u
 				uidentity.Enrollments[ei].End = gDefaultEndDate
 			}
 		}
-		if mtx != nil {
-			mtx.Lock()
-		}
-		uidentitiesAry[idx].Idents = uidentity.Idents
-		if mtx != nil {
-			mtx.Unlock()
-		}
-		uuid = lookupUIdentity(db, dbg, &uidentity)
+		uuid, ambiguous := lookupUIdentity(store, &uidentity, log)
 		if uuid == "" {
-			if dbg {
-				fmt.Printf("WARNING: cannot find %s identity in our database\n", uidentity.String())
+			gStats.inc(cPhaseLookup, "missing")
+			if ambiguous {
+				gStats.inc(cPhaseLookup, "ambiguous")
 			}
+			log.debug("cannot find identity in our database", "ambiguous", ambiguous, "identity", uidentity.String())
 			return
 		}
-		if dbg {
-			fmt.Printf("found %s\n", uidentity.String())
-		}
+		gStats.inc(cPhaseLookup, "found")
+		log.debug("found identity", "uuid", uuid, "identity", uidentity.String())
 		return
 	}
-	processResult := func(result resultType) {
-		idx := result.i
-		uuid := result.uuid
-		if uuid == "skip" {
-			return
+	pool := newWorkerPool(ctx, getPhaseThreadsNum("LOOKUP_THREADS"))
+	for {
+		uidentity, ok := next()
+		if !ok {
+			break
 		}
-		if uuid != "" {
-			setUUID(&uidentitiesAry[idx], uuid)
-			uidentitiesMap[uuid] = uidentitiesAry[idx]
-		} else {
-			missing = append(missing, uidentitiesAry[idx])
+		mtx.Lock()
+		idx := len(uidentitiesAry)
+		uidentitiesAry = append(uidentitiesAry, uidentity)
+		uuids = append(uuids, "skip")
+		mtx.Unlock()
+		gStats.inc(cPhaseLookup, "profiles")
+		if !pool.run(func() { processItem(idx, uidentity) }) {
+			gLog.warn("lookups cancelled", "phase", cPhaseLookup, "done", idx)
+			break
 		}
 	}
-	thrN := getThreadsNum()
-	ch := make(chan resultType)
-	if thrN > 1 {
-		nThreads := 0
-		mtx = &sync.Mutex{}
-		for i, uidentity := range uidentitiesAry {
-			go processItem(ch, i, uidentity)
-			nThreads++
-			if nThreads == thrN {
-				processResult(<-ch)
-				nThreads--
-			}
+	pool.wait()
+	out.flush()
+	duplicatesPolicy := os.Getenv("DUPLICATES_POLICY")
+	if duplicatesPolicy == "" {
+		duplicatesPolicy = cDuplicatesMerge
+	}
+	if duplicatesPolicy != cDuplicatesMerge && duplicatesPolicy != cDuplicatesReject {
+		fatalf("unknown DUPLICATES_POLICY '%s', allowed: %s, %s", duplicatesPolicy, cDuplicatesMerge, cDuplicatesReject)
+	}
+	rejected := make(map[string]struct{})
+	for idx, uuid := range uuids {
+		if uuid == "skip" {
+			continue
 		}
-		for nThreads > 0 {
-			processResult(<-ch)
-			nThreads--
+		if uuid == "" {
+			missing = append(missing, uidentitiesAry[idx])
+			continue
 		}
-	} else {
-		for i, uidentity := range uidentitiesAry {
-			processResult(processItem(nil, i, uidentity))
+		setUUID(&uidentitiesAry[idx], uuid)
+		existing, ok := uidentitiesMap[uuid]
+		if !ok {
+			uidentitiesMap[uuid] = uidentitiesAry[idx]
+			continue
 		}
+		// the same person defined more than once in a single file
+		gStats.inc(cPhaseLookup, "duplicates")
+		gLog.debug("duplicate profile", "phase", cPhaseLookup, "source", uidentitiesAry[idx].source(), "duplicate_of", existing.source(), "uuid", uuid)
+		if duplicatesPolicy == cDuplicatesReject {
+			rejected[uuid] = struct{}{}
+			duplicates = append(duplicates, mergeConflict{uuid: uuid, winner: existing, loser: uidentitiesAry[idx], resolution: "rejected"})
+			continue
+		}
+		uidentitiesMap[uuid] = mergeUIdentity(existing, uidentitiesAry[idx])
+		duplicates = append(duplicates, mergeConflict{uuid: uuid, winner: existing, loser: uidentitiesAry[idx], resolution: "merged"})
 	}
-	if len(missing) > 0 {
-		fmt.Printf("cannot find %d profiles\n", len(missing))
+	for uuid := range rejected {
+		delete(uidentitiesMap, uuid)
 	}
 	return
 }
 
-func cleanupUnaffiliated(dbg bool, uidentities []shUIdentity) {
+func cleanupUnaffiliated(uidentity *shUIdentity) {
 	// Remove: Unaffiliated
 	// Possibly: Individual Contributor
-	for i, uidentity := range uidentities {
-		for j, enrollment := range uidentity.Enrollments {
-			if enrollment.Organization == "Unaffiliated" {
-				last := len(uidentities[i].Enrollments) - 1
-				if last == 0 {
-					uidentities[i].Enrollments = []shEnrollment{}
-					if dbg {
-						fmt.Printf("removed %s enrollment: no enrollments left: %s\n", enrollment.Organization, uidentities[i].String())
-					}
-					continue
-				}
-				uidentities[i].Enrollments[j] = uidentities[i].Enrollments[last]
-				uidentities[i].Enrollments = uidentities[i].Enrollments[:last]
-				if dbg {
-					fmt.Printf("removed %s enrollment: new enrollments: %v: %s\n", enrollment.Organization, uidentities[i].Enrollments, uidentities[i].String())
-				}
+	for j, enrollment := range uidentity.Enrollments {
+		if enrollment.Organization == "Unaffiliated" {
+			gStats.inc(cPhaseCleanup, "unaffiliated_removed")
+			last := len(uidentity.Enrollments) - 1
+			if last == 0 {
+				gStats.inc(cPhaseCleanup, "left_without_enrollments")
+				uidentity.Enrollments = []shEnrollment{}
+				gLog.debug("removed enrollment, no enrollments left", "phase", cPhaseCleanup, "source", uidentity.source(), "org", enrollment.Organization, "identity", uidentity.String())
+				continue
+			}
+			uidentity.Enrollments[j] = uidentity.Enrollments[last]
+			uidentity.Enrollments = uidentity.Enrollments[:last]
+			gLog.debug("removed enrollment", "phase", cPhaseCleanup, "source", uidentity.source(), "org", enrollment.Organization, "identity", uidentity.String())
+		}
+	}
+}
+
+// decodeIdentity - decodes a single identities file item, both into structures and into dynamic fields (data sources)
+// Each identity remembers its source file and line number
+func decodeIdentity(fileName string, item *yaml.Node) (uidentity shUIdentity) {
+	var unknown map[string]interface{}
+	err := item.Decode(&uidentity)
+	if err != nil {
+		// name the record, profile can usually be decoded even when enrollments can't
+		var named struct {
+			Profile shProfile `yaml:"profile"`
+		}
+		_ = item.Decode(&named)
+		fatalf("%s:%d: profile '%s': %v", fileName, item.Line, named.Profile.Name, err)
+	}
+	err = item.Decode(&unknown)
+	if err != nil {
+		fatalf("%s:%d: cannot parse dynamic datasource identities list fields: %v", fileName, item.Line, err)
+	}
+	normalizeProfile(&uidentity.Profile)
+	uidentity.SourceFile = fileName
+	uidentity.SourceLine = item.Line
+	record, err := yaml.Marshal(unknown)
+	fatalOnError(err)
+	uidentity.SourceRecord = string(record)
+	uidentity.Idents = make(map[string][]string)
+	for k, iv := range unknown {
+		if k == "profile" || k == "enrollments" || k == "email" || k == "project_slug" {
+			continue
+		}
+		v, ok := iv.([]interface{})
+		if !ok {
+			fatalf("%s:%d: dynamic datasource identities list - cannot parse key %s value %v,%T as array", fileName, item.Line, k, iv, iv)
+		}
+		others := []string{}
+		for _, it := range v {
+			its, ok := it.(string)
+			if !ok {
+				fatalf("%s:%d: dynamic datasource identities list - cannot parse key %s value %v item %v,%T as string", fileName, item.Line, k, v, it, it)
 			}
+			others = append(others, its)
 		}
+		uidentity.Idents[k] = others
 	}
+	return
+}
+
+// readIdentities - returns function yielding identities from a given file one at a time (false when there are no more)
+// File is parsed as it is consumed, so lookups can start before the whole file is read
+func readIdentities(fileName string) (next func() (shUIdentity, bool), closeFile func()) {
+	stream, err := openIdentitiesStream(fileName)
+	fatalOnError(err)
+	next = func() (uidentity shUIdentity, ok bool) {
+		stop := gStats.phase(cPhaseParse)
+		item, err := stream.nextItem()
+		if err == io.EOF {
+			stop()
+			return
+		}
+		fatalOnError(err)
+		uidentity = decodeIdentity(fileName, item)
+		gStats.inc(cPhaseParse, "records")
+		stop()
+		stop = gStats.phase(cPhaseCleanup)
+		cleanupUnaffiliated(&uidentity)
+		stop()
+		return uidentity, true
+	}
+	return next, stream.close
 }
 
-func importYAMLfiles(db *sql.DB, fileNames []string) error {
-	dbg := os.Getenv("DEBUG") != ""
+func importYAMLfiles(ctx context.Context, store shStorage, fileNames []string) error {
 	dry := os.Getenv("DRY") != ""
 	replace := os.Getenv("REPLACE") != ""
 	compare := os.Getenv("COMPARE") != ""
+	updateProfiles := os.Getenv("UPDATE_PROFILES") != ""
 	projectSlug := os.Getenv("PROJECT_SLUG")
 	if projectSlug != "" {
 		gProjectSlug = &projectSlug
 	}
-	gDebugSQL = os.Getenv("DEBUG_SQL") != ""
-	nFiles := len(fileNames)
-	if dbg {
-		fmt.Printf("importing %d files, debug: %v, dry-run: %v, compare mode: %v, replace mode: %v\n", nFiles, dbg, dry, compare, replace)
+	gOrdered = os.Getenv("ORDERED") != ""
+	gStats = newRunStats()
+	manifest := readProjectsManifest(os.Getenv("PROJECTS_MANIFEST"))
+	if len(fileNames) == 0 {
+		fileNames = manifest.fileNames()
 	}
+	manifest.checkFileNames(fileNames)
+	nFiles := len(fileNames)
+	gLog.debug("importing files", "files", nFiles, "dry_run", dry, "compare", compare, "replace", replace, "update_profiles", updateProfiles, "ordered", gOrdered)
 	uidentitiesAry := []map[string]shUIdentity{}
 	orgs := make(map[string]struct{})
+	orgSources := make(map[string][]string)
 	missingOrgs := make(map[string]struct{})
 	missingProfiles := []shUIdentity{}
+	duplicateProfiles := []mergeConflict{}
 	timeSuff := func() string {
 		dt := time.Now()
 		return fmt.Sprintf("_%04d%02d%02d%02d%02d%02d%09d", dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second(), dt.Nanosecond())
 	}
 	for i, fileName := range fileNames {
-		fmt.Printf("importing %d/%d: %s\n", i+1, nFiles, fileName)
-		var (
-			yAry []shUIdentity
-			iAry []interface{}
-			data shData
-		)
-		contents, err := ioutil.ReadFile(fileName)
-		fatalOnError(err)
-		fatalOnError(yaml.Unmarshal(contents, &yAry))
-		fatalOnError(yaml.Unmarshal(contents, &iAry))
-		cleanupUnaffiliated(dbg, yAry)
+		if ctx.Err() != nil {
+			break
+		}
+		projectSlugs := manifest.fileProjectSlugs(fileName)
+		slugs := []string{}
+		for _, projectSlug := range projectSlugs {
+			slugs = append(slugs, slugKey(projectSlug))
+		}
+		gLog.info("importing file", "file", fileName, "n", i+1, "files", nFiles, "project_slugs", strings.Join(slugs, ","))
+		gSummary.addInput(fileName, slugs)
+		var data shData
+		next, closeFile := readIdentities(fileName)
+		gStats.inc(cPhaseParse, "files")
 		data.UIdentities = make(map[string]shUIdentity)
-		missing := postprocessIdentities(db, dbg, yAry, iAry, data.UIdentities)
+		// parsing and cleanup happen while lookups run, their durations are included in lookup duration too
+		stop := gStats.phase(cPhaseLookup)
+		missing, duplicates := postprocessIdentities(ctx, store, next, data.UIdentities, projectSlugs)
+		stop()
+		closeFile()
 		for _, miss := range missing {
 			missingProfiles = append(missingProfiles, miss)
 		}
-		fmt.Printf("%s: %d records\n", fileName, len(data.UIdentities))
-		for _, uidentity := range data.UIdentities {
+		duplicateProfiles = append(duplicateProfiles, duplicates...)
+		gLog.info("file processed", "file", fileName, "uidentities", len(data.UIdentities))
+		uidentitiesAry = append(uidentitiesAry, data.UIdentities)
+	}
+	if len(duplicateProfiles) > 0 {
+		fn := os.Getenv("DUPLICATES_CSV")
+		if fn == "" {
+			fn = "duplicates"
+		}
+		saveMergeConflicts(fn+timeSuff()+".csv", duplicateProfiles)
+	}
+	stop := gStats.phase(cPhaseMerge)
+	uidentities, mergeConflicts := mergeFiles(fileNames, uidentitiesAry)
+	gStats.add(cPhaseMerge, "profiles", len(uidentities))
+	gStats.add(cPhaseMerge, "conflicts", len(mergeConflicts))
+	stop()
+	if len(mergeConflicts) > 0 {
+		fn := os.Getenv("FILE_CONFLICTS_CSV")
+		if fn == "" {
+			fn = "file_conflicts"
+		}
+		saveMergeConflicts(fn+timeSuff()+".csv", mergeConflicts)
+	}
+	// project slugs come from the manifest, PROJECT_SLUG or YAML, storage without them must fail before any change is made
+	if !store.hasProjectSlugs() {
+		uuids := []string{}
+		for uuid := range uidentities {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
+		for _, uuid := range uuids {
+			uidentity := uidentities[uuid]
 			for _, enrollment := range uidentity.Enrollments {
-				orgs[enrollment.Organization] = struct{}{}
+				if enrollment.ProjectSlug != nil {
+					fatalf("storage has no project slugs, %s has enrollment in project '%s'", uidentity.source(), *enrollment.ProjectSlug)
+				}
 			}
 		}
-		uidentitiesAry = append(uidentitiesAry, data.UIdentities)
+	}
+	for _, uidentity := range uidentities {
+		for _, enrollment := range uidentity.Enrollments {
+			orgs[enrollment.Organization] = struct{}{}
+			orgSources[enrollment.Organization] = append(orgSources[enrollment.Organization], uidentity.source())
+		}
 	}
 	if len(missingProfiles) > 0 {
 		fn := os.Getenv("MISSING_PROFILES_CSV")
@@ -612,7 +847,7 @@ func importYAMLfiles(db *sql.DB, fileNames []string) error {
 		fatalOnError(err)
 		defer func() { _ = csvFile.Close() }()
 		writer := csv.NewWriter(csvFile)
-		fatalOnError(writer.Write([]string{"Name", "Emails", "Identities", "Enrollments"}))
+		fatalOnError(writer.Write([]string{"Name", "Emails", "Identities", "Enrollments", "Source"}))
 		for _, uidentity := range missingProfiles {
 			rols := ""
 			for _, rol := range uidentity.Enrollments {
@@ -629,7 +864,8 @@ func importYAMLfiles(db *sql.DB, fileNames []string) error {
 				rols = rols[:len(rols)-1]
 			}
 			idents := ""
-			for source, userNames := range uidentity.Idents {
+			for _, source := range sortedSources(uidentity.Idents) {
+				userNames := uidentity.Idents[source]
 				idents += source + ": ["
 				for _, userName := range userNames {
 					idents += userName + ","
@@ -639,62 +875,69 @@ func importYAMLfiles(db *sql.DB, fileNames []string) error {
 			if idents != "" {
 				idents = idents[:len(idents)-1]
 			}
-			err = writer.Write(
+			fatalOnError(writer.Write(
 				[]string{
 					uidentity.Profile.Name,
 					strings.Join(uidentity.Emails, ","),
 					idents,
 					rols,
+					uidentity.source(),
 				},
-			)
+			))
 		}
 		writer.Flush()
+		fatalOnError(writer.Error())
+	}
+	if ctx.Err() != nil {
+		gLog.warn("interrupted, skipping organizations mapping and enrollments sync")
+		return ctx.Err()
 	}
-	fmt.Printf("%d orgs present in import files\n", len(orgs))
+	stop = gStats.phase(cPhaseOrgMapping)
+	gStats.add(cPhaseOrgMapping, "orgs", len(orgs))
 	comp2id := make(map[string]int)
 	id2comp := make(map[int]string)
 	lcomp2id := make(map[string]int)
 	id2lcomp := make(map[int]string)
-	rows, err := query(db, "select id, name from organizations")
+	allOrgs, err := store.organizations()
 	fatalOnError(err)
-	orgID := 0
-	orgName := ""
-	for rows.Next() {
-		fatalOnError(rows.Scan(&orgID, &orgName))
-		lOrgName := strings.ToLower(orgName)
+	for orgID, orgName := range allOrgs {
+		lOrgName := normalizeKey(orgName)
 		comp2id[orgName] = orgID
 		id2comp[orgID] = orgName
 		lcomp2id[lOrgName] = orgID
 		id2lcomp[orgID] = lOrgName
 	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
 	if dry {
-		fmt.Printf("Returing due to dry-run mode\n")
+		stop()
+		gLog.info("returning due to dry-run mode")
 		return nil
 	}
-	//fmt.Printf("comp2id: %+v\n", comp2id)
-	//fmt.Printf("id2comp: %+v\n", id2comp)
-	//fmt.Printf("lcomp2id: %+v\n", lcomp2id)
-	//fmt.Printf("id2lcomp: %+v\n", id2lcomp)
-	orgsMissing := 0
 	var orgNamesMappings allMappings
-	thrN := getThreadsNum()
 	mut := &sync.RWMutex{}
 	orgsLoaded := false
-	processOrg := func(ch chan struct{}, comp string) {
-		defer func() {
-			if ch != nil {
-				ch <- struct{}{}
+	// in ordered mode organization id is always reported under the same name, regardless of processing order
+	setOrgName := func(cid int, comp string) {
+		if gOrdered {
+			name, ok := id2comp[cid]
+			if ok && name < comp {
+				return
 			}
-		}()
+		}
+		id2comp[cid] = comp
+	}
+	out := newOrderedOutput()
+	processOrg := func(idx int, comp string) {
+		item := out.logger(idx)
+		defer item.done()
+		log := gLog.with("phase", cPhaseOrgMapping, "org", comp).into(item)
 		mut.RLock()
 		cid, exists := comp2id[comp]
 		mut.RUnlock()
 		if !exists {
+			// lcomp2id is keyed by normalizeKey (case and diacritics insensitive), mappings regexps are matched against lower case name
 			lComp := strings.ToLower(comp)
 			mut.RLock()
-			_, exists = lcomp2id[lComp]
+			cid, exists = lcomp2id[normalizeKey(comp)]
 			mut.RUnlock()
 			if !exists {
 				mut.RLock()
@@ -713,140 +956,105 @@ func importYAMLfiles(db *sql.DB, fileNames []string) error {
 				} else {
 					mut.RUnlock()
 				}
-				if dbg {
-					fmt.Printf("missing '%s'\n", comp)
-				}
+				log.debug("missing")
 				found := false
 				for _, mapping := range orgNamesMappings.Mappings {
 					re := mapping[0]
 					re = strings.Replace(re, "\\\\", "\\", -1)
-					if dbg {
-						fmt.Printf("check if '%s' matches '%s'\n", comp, re)
-					}
+					log.debug("checking mapping", "regexp", re)
 					// if comp matches re then to is our mapped company name
-					rows, err := query(db, "select ? regexp ?", comp, re)
+					m, err := store.matchesRegexp(comp, re)
 					fatalOnError(err)
-					var m int
-					for rows.Next() {
-						fatalOnError(rows.Scan(&m))
-					}
-					fatalOnError(rows.Err())
-					fatalOnError(rows.Close())
-					if m > 0 {
-						if dbg {
-							fmt.Printf("'%s' matches '%s'\n", comp, re)
-						}
+					if m {
+						log.debug("matches", "regexp", re)
 						to := mapping[1]
 						mut.RLock()
 						cid, exists := comp2id[to]
 						mut.RUnlock()
 						if exists {
-							if dbg {
-								fmt.Printf("added mapping '%s' -> '%s' -> %d\n", comp, to, cid)
-							}
+							log.debug("added mapping", "to", to, "org_id", cid)
 							mut.Lock()
 							comp2id[comp] = cid
 							// Consider
-							id2comp[cid] = comp
+							setOrgName(cid, comp)
 							//id2comp[cid] = to
 							mut.Unlock()
+							gStats.inc(cPhaseOrgMapping, "mapped")
 							found = true
 							break
 						} else {
-							fmt.Printf("'%s' maps to '%s' which cannot be found\n", comp, to)
+							log.warn("mapped organization cannot be found", "to", to)
+							gStats.inc(cPhaseOrgMapping, "mapped_to_unknown")
 						}
 					} else {
-						if dbg {
-							fmt.Printf("'%s' is not matching '%s'\n", comp, re)
-						}
+						log.debug("not matching", "regexp", re)
 					}
 				}
 				if found {
 					return
 				}
-				if dbg {
-					fmt.Printf("missing '%s' (trying lower case '%s')\n", comp, lComp)
-				}
+				log.debug("missing, trying lower case", "lower_case", lComp)
 				for _, mapping := range orgNamesMappings.Mappings {
 					re := mapping[0]
 					re = strings.Replace(re, "\\\\", "\\", -1)
-					if dbg {
-						fmt.Printf("check if '%s' matches '%s'\n", lComp, re)
-					}
+					log.debug("checking mapping", "lower_case", lComp, "regexp", re)
 					// if lComp matches re then to is our mapped company name
-					rows, err := query(db, "select ? regexp ?", lComp, re)
+					m, err := store.matchesRegexp(lComp, re)
 					fatalOnError(err)
-					var m int
-					for rows.Next() {
-						fatalOnError(rows.Scan(&m))
-					}
-					fatalOnError(rows.Err())
-					fatalOnError(rows.Close())
-					if m > 0 {
-						if dbg {
-							fmt.Printf("'%s' matches '%s'\n", lComp, re)
-						}
+					if m {
+						log.debug("matches", "lower_case", lComp, "regexp", re)
 						to := mapping[1]
 						mut.RLock()
-						cid, exists := lcomp2id[to]
+						cid, exists := lcomp2id[normalizeKey(to)]
 						mut.RUnlock()
 						if exists {
-							if dbg {
-								fmt.Printf("added mapping '%s' -> '%s' -> %d\n", lComp, to, cid)
-							}
+							log.debug("added mapping", "lower_case", lComp, "to", to, "org_id", cid)
 							mut.Lock()
 							comp2id[comp] = cid
 							// Consider
-							id2comp[cid] = comp
+							setOrgName(cid, comp)
 							// id2comp[cid] = to
 							mut.Unlock()
+							gStats.inc(cPhaseOrgMapping, "mapped_lower_case")
 							found = true
 							break
 						} else {
-							fmt.Printf("'%s' maps to '%s' which cannot be found\n", lComp, to)
+							log.warn("mapped organization cannot be found", "lower_case", lComp, "to", to)
+							gStats.inc(cPhaseOrgMapping, "mapped_to_unknown")
 						}
 					} else {
-						if dbg {
-							fmt.Printf("'%s' is not matching '%s'\n", lComp, re)
-						}
+						log.debug("not matching", "lower_case", lComp, "regexp", re)
 					}
 				}
 				if !found {
-					fmt.Printf("nothing found for '%s'\n", comp)
+					log.warn("organization not found")
+					gStats.inc(cPhaseOrgMapping, "missing")
 					mut.Lock()
-					orgsMissing++
 					missingOrgs[comp] = struct{}{}
 					mut.Unlock()
 				}
 			} else {
+				gStats.inc(cPhaseOrgMapping, "found_lower_case")
 				mut.Lock()
 				comp2id[comp] = cid
-				id2comp[cid] = comp
+				setOrgName(cid, comp)
 				mut.Unlock()
 			}
+		} else {
+			gStats.inc(cPhaseOrgMapping, "found")
 		}
 	}
-	if thrN > 1 {
-		ch := make(chan struct{})
-		nThreads := 0
-		for org := range orgs {
-			go processOrg(ch, org)
-			nThreads++
-			if nThreads == thrN {
-				<-ch
-				nThreads--
-			}
-		}
-		for nThreads > 0 {
-			<-ch
-			nThreads--
-		}
-	} else {
-		for org := range orgs {
-			processOrg(nil, org)
+	pool := newWorkerPool(ctx, getPhaseThreadsNum("LOOKUP_THREADS"))
+	for i, org := range sortedKeys(orgs) {
+		idx, comp := i, org
+		if !pool.run(func() { processOrg(idx, comp) }) {
+			gLog.warn("organizations mapping cancelled", "phase", cPhaseOrgMapping, "done", idx, "orgs", len(orgs))
+			break
 		}
 	}
-	// fmt.Printf("comp2id:%+v\nod2comp:%+v\n", comp2id, id2comp)
+	pool.wait()
+	out.flush()
+	stop()
 	if len(missingOrgs) > 0 {
 		fn := os.Getenv("MISSING_ORGS_CSV")
 		if fn == "" {
@@ -856,57 +1064,104 @@ func importYAMLfiles(db *sql.DB, fileNames []string) error {
 		fatalOnError(err)
 		defer func() { _ = csvFile.Close() }()
 		writer := csv.NewWriter(csvFile)
-		fatalOnError(writer.Write([]string{"Organization Name"}))
-		for org := range missingOrgs {
-			err = writer.Write([]string{org})
+		fatalOnError(writer.Write([]string{"Organization Name", "Sources"}))
+		for _, org := range sortedKeys(missingOrgs) {
+			sources := orgSources[org]
+			sort.Strings(sources)
+			fatalOnError(writer.Write([]string{org, strings.Join(sources, ",")}))
 		}
 		writer.Flush()
+		fatalOnError(writer.Error())
+	}
+	if gLog.enabled(cLevelDebug) {
+		gLog.debug("organizations", "phase", cPhaseOrgMapping, "comp2id", comp2id, "id2comp", id2comp, "lcomp2id", lcomp2id, "id2lcomp", id2lcomp)
+	}
+	if ctx.Err() != nil {
+		gLog.warn("interrupted, skipping enrollments sync")
+		return ctx.Err()
+	}
+	mtx := &sync.RWMutex{}
+	policy := newOwnershipPolicy()
+	audit := newAuditLog(store)
+	out = newOrderedOutput()
+	stop = gStats.phase(cPhaseSync)
+	pool = newWorkerPool(ctx, getPhaseThreadsNum("WRITE_THREADS"))
+	for i, uuid := range sortedUUIDs(uidentities) {
+		uidentity, item := uidentities[uuid], out.logger(i)
+		log := gLog.with("phase", cPhaseSync, "uuid", uuid, "source", uidentity.source()).into(item)
+		if !pool.run(func() {
+			defer item.done()
+			processUIdentity(mtx, store, uidentity, comp2id, id2comp, []bool{replace, compare, updateProfiles}, policy, audit, log)
+		}) {
+			gLog.warn("enrollments sync cancelled", "phase", cPhaseSync, "done", i, "profiles", len(uidentities))
+			break
+		}
 	}
-	if dbg {
-		fmt.Printf("comp2id: %+v\n", comp2id)
-		fmt.Printf("id2comp: %+v\n", id2comp)
-		fmt.Printf("lcomp2id: %+v\n", lcomp2id)
-		fmt.Printf("id2lcomp: %+v\n", id2lcomp)
-	}
-	fmt.Printf("Number of organizations: %d, missing: %d\n", len(comp2id), orgsMissing)
-	var mtx *sync.RWMutex
-	if thrN > 1 {
-		mtx = &sync.RWMutex{}
-	}
-	stats := &importStats{}
-	for _, uidentities := range uidentitiesAry {
-		if thrN > 1 {
-			ch := make(chan struct{})
-			nThreads := 0
-			for _, uidentity := range uidentities {
-				go processUIdentity(ch, mtx, db, uidentity, comp2id, id2comp, []bool{dbg, replace, compare}, stats)
-				nThreads++
-				if nThreads == thrN {
-					<-ch
-					nThreads--
-				}
+	pool.wait()
+	out.flush()
+	stop()
+	if len(policy.conflicts) > 0 {
+		fn := os.Getenv("ORIGIN_CONFLICTS_CSV")
+		if fn == "" {
+			fn = "origin_conflicts"
+		}
+		csvFile, err := os.Create(fn + timeSuff() + ".csv")
+		fatalOnError(err)
+		defer func() { _ = csvFile.Close() }()
+		writer := csv.NewWriter(csvFile)
+		fatalOnError(writer.Write([]string{"UUID", "Project Slug", "Origin", "Organization", "Start", "End", "Resolution", "Imported Enrollments", "Source"}))
+		sort.SliceStable(policy.conflicts, func(i, j int) bool {
+			ci, cj := &policy.conflicts[i], &policy.conflicts[j]
+			ki, kj := ci.enrollment.String(), cj.enrollment.String()
+			if ki == kj {
+				return ci.source < cj.source
 			}
-			for nThreads > 0 {
-				<-ch
-				nThreads--
+			return ki < kj
+		})
+		for _, conflict := range policy.conflicts {
+			rol := conflict.enrollment
+			origin := "null"
+			if rol.Origin != nil {
+				origin = *rol.Origin
 			}
-		} else {
-			for _, uidentity := range uidentities {
-				processUIdentity(nil, mtx, db, uidentity, comp2id, id2comp, []bool{dbg, replace, compare}, stats)
+			rols := []string{}
+			for _, imported := range conflict.imported {
+				rols = append(rols, imported.Organization+" from:"+toYMDDate(imported.Start)+" to:"+toYMDDate(imported.End))
 			}
+			fatalOnError(writer.Write(
+				[]string{
+					rol.UUID,
+					slugKey(rol.ProjectSlug),
+					origin,
+					rol.Organization,
+					toYMDDate(rol.Start),
+					toYMDDate(rol.End),
+					conflict.resolution,
+					strings.Join(rols, ","),
+					conflict.source,
+				},
+			))
 		}
+		writer.Flush()
+		fatalOnError(writer.Error())
 	}
-	fmt.Printf("Stats:\n%+v\n", stats)
-	return nil
+	return ctx.Err()
 }
 
 func profilesDiffer(p1, p2 *shProfile) bool {
-	if stripUnicodeStr(p1.Name) != stripUnicodeStr(p2.Name) {
+	if !sameKey(p1.Name, p2.Name) {
 		return true
 	}
 	if p1.IsBot != nil && p2.IsBot != nil && *p1.IsBot != *p2.IsBot {
 		return true
 	}
+	// optional fields only differ when both profiles have them
+	for _, field := range gProfileFields {
+		v1, v2 := field.get(p1), field.get(p2)
+		if v1 != nil && v2 != nil && !strings.EqualFold(*v1, *v2) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -934,181 +1189,134 @@ func enrollmentsDiffer(e1, e2 []shEnrollment) bool {
 	return false
 }
 
-func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity shUIdentity, comp2id map[string]int, id2comp map[int]string, flags []bool, stats *importStats) {
-	defer func() {
-		if ch != nil {
-			ch <- struct{}{}
-		}
-	}()
-	var sts importStats
-	defer func() {
-		if mtx != nil {
-			mtx.Lock()
-		}
-		stats.uidentitiesFound += sts.uidentitiesFound
-		stats.uidentitiesNotFound += sts.uidentitiesNotFound
-		stats.profilesFound += sts.profilesFound
-		stats.profilesSame += sts.profilesSame
-		stats.identitiesFound += sts.identitiesFound
-		stats.identitiesSame += sts.identitiesSame
-		stats.enrollmentsFound += sts.enrollmentsFound
-		stats.enrollmentsSame += sts.enrollmentsSame
-		stats.enrollmentsAdded += sts.enrollmentsAdded
-		stats.enrollmentsSkipped += sts.enrollmentsSkipped
-		stats.enrollmentsDeleted += sts.enrollmentsDeleted
-		if mtx != nil {
-			mtx.Unlock()
-		}
-	}()
-	_, _ = db.Exec("set @origin = ?", cOrigin)
-	dbg := flags[0]
-	replace := flags[1]
-	compare := flags[2]
-	rows, err := query(db, "select uuid from uidentities where uuid = ?", uidentity.UUID)
+func processUIdentity(mtx *sync.RWMutex, store shStorage, uidentity shUIdentity, comp2id map[string]int, id2comp map[int]string, flags []bool, policy *ownershipPolicy, audit *auditLog, log *logger) {
+	compare := flags[1]
+	updateProfiles := flags[2]
+	fetched, err := store.uidentityExists(uidentity.UUID)
 	fatalOnError(err)
-	uuid := uidentity.UUID
-	fetched := false
-	for rows.Next() {
-		fatalOnError(rows.Scan(&uuid))
-		fetched = true
-		break
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
 	if !fetched {
-		fmt.Printf("cannot find uidentity '%s'\n", uidentity.UUID)
-		sts.uidentitiesNotFound++
+		log.warn("cannot find uidentity")
+		gStats.inc(cPhaseSync, "uidentities_not_found")
 		return
 	}
-	sts.uidentitiesFound++
-	var existingProfile shProfile
-	rows, err = query(
-		db,
-		"select uuid, coalesce(name, ''), is_bot from profiles where uuid = ?",
-		uidentity.UUID,
-	)
+	gStats.inc(cPhaseSync, "uidentities_found")
+	existingProfile, err := store.profile(uidentity.UUID)
 	fatalOnError(err)
-	fetched = false
-	for rows.Next() {
-		fatalOnError(
-			rows.Scan(
-				&existingProfile.UUID,
-				&existingProfile.Name,
-				&existingProfile.IsBot,
-			),
-		)
-		fetched = true
-		break
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
+	fetched = existingProfile != nil
 	if fetched {
-		sts.profilesFound++
+		gStats.inc(cPhaseSync, "profiles_found")
 	}
 	same := false
 	if fetched && compare {
-		same = !profilesDiffer(&uidentity.Profile, &existingProfile)
+		same = !profilesDiffer(&uidentity.Profile, existingProfile)
 		if same {
-			sts.profilesSame++
-		} else if dbg {
-			fmt.Printf("Profiles differ: %s != %s\n", uidentity.Profile.String(), existingProfile.String())
+			gStats.inc(cPhaseSync, "profiles_same")
+		} else {
+			log.debug("profiles differ", "profile", uidentity.Profile.String(), "existing", existingProfile.String())
+		}
+	}
+	// profile fields given in the file are written when they differ, fields not given are kept
+	if fetched && updateProfiles {
+		updated, fields := profileChanges(&uidentity.Profile, existingProfile)
+		if len(fields) > 0 {
+			log.debug("updating profile", "fields", strings.Join(fields, ","), "profile", updated.String(), "existing", existingProfile.String())
+			fatalOnError(store.updateProfile(&updated, fields))
+			audit.profileUpdated(store, &uidentity, existingProfile, &updated)
+			gStats.inc(cPhaseSync, "profiles_updated")
 		}
 	}
 	emails := make(map[string]struct{})
 	for _, email := range uidentity.Emails {
-		emails[stripUnicodeStr(email)] = struct{}{}
+		emails[normalizeKey(email)] = struct{}{}
 	}
 	if len(emails) > 0 && compare {
-		for source, userNames := range uidentity.Idents {
+		for _, source := range sortedSources(uidentity.Idents) {
+			userNames := uidentity.Idents[source]
 			for _, userName := range userNames {
-				eemail := ""
-				rows, err = query(
-					db,
-					"select coalesce(email, '') from identities where uuid = ? and source = ? and username = ? and email is not null",
-					uidentity.UUID,
-					source,
-					stripUnicodeStr(userName),
-				)
+				eemail, fetched, err := store.identityEmail(uidentity.UUID, source, userName)
 				fatalOnError(err)
-				fetched = false
-				for rows.Next() {
-					fatalOnError(rows.Scan(&eemail))
-					eemail = stripUnicodeStr(eemail)
-					fetched = true
-					break
-				}
-				fatalOnError(rows.Err())
-				fatalOnError(rows.Close())
+				eemail = normalizeKey(eemail)
 				if fetched {
-					sts.identitiesFound++
+					gStats.inc(cPhaseSync, "identities_found")
 				}
 				same = false
 				if fetched {
 					_, ok := emails[eemail]
 					if ok {
-						sts.identitiesSame++
-					} else if dbg {
-						fmt.Printf("Identities differ uuid: %s source: %s, username: %s, email %s not in %v\n", uidentity.UUID, source, userName, eemail, emails)
+						gStats.inc(cPhaseSync, "identities_same")
+					} else {
+						log.debug("identities differ", "source_name", source, "username", userName, "email", eemail, "emails", sortedKeys(emails))
 					}
 				}
 			}
 		}
 	}
-	queryStr := ""
-	if gProjectSlug == nil {
-		if compare {
-			queryStr = "select uuid, organization_id, start, end, project_slug from enrollments where uuid = ? and project_slug is null"
-		} else {
-			queryStr = "select uuid from enrollments where uuid = ? and project_slug is null"
-		}
-		rows, err = query(db, queryStr, uidentity.UUID)
-	} else {
-		if compare {
-			queryStr = "select uuid, organization_id, start, end, project_slug from enrollments where uuid = ? and project_slug = ?"
-		} else {
-			queryStr = "select uuid from enrollments where uuid = ? and project_slug = ?"
+	// enrollments for each project slug are synced independently
+	slugs := []string{}
+	slugEnrollments := make(map[string][]shEnrollment)
+	slugPtrs := make(map[string]*string)
+	for _, enrollment := range uidentity.Enrollments {
+		slug := slugKey(enrollment.ProjectSlug)
+		_, ok := slugPtrs[slug]
+		if !ok {
+			slugs = append(slugs, slug)
+			slugPtrs[slug] = enrollment.ProjectSlug
 		}
-		rows, err = query(db, queryStr, uidentity.UUID, *gProjectSlug)
+		slugEnrollments[slug] = append(slugEnrollments[slug], enrollment)
+	}
+	for _, slug := range slugs {
+		uidentity.Enrollments = slugEnrollments[slug]
+		processEnrollments(mtx, store, uidentity, slugPtrs[slug], comp2id, id2comp, flags, policy, audit, log.with("project_slug", slug))
 	}
+}
+
+// processEnrollments - sync enrollments of a given uidentity within a single project slug
+// Existing enrollments that belong to origins taking precedence over the import (see ownershipPolicy) are never
+// replaced and imported enrollments are skipped; if they differ from imported ones this is reported as a conflict
+func processEnrollments(mtx *sync.RWMutex, store shStorage, uidentity shUIdentity, projectSlug *string, comp2id map[string]int, id2comp map[int]string, flags []bool, policy *ownershipPolicy, audit *auditLog, log *logger) {
+	replace := flags[0]
+	compare := flags[1]
+	slug := slugKey(projectSlug)
+	count := func(counter string) {
+		gStats.inc(cPhaseSync, counter)
+		gStats.inc(projectGroup(slug), counter)
+	}
+	withOrigin := policy.mode != cOwnershipAll
+	// legacy mode doesn't need enrollments data when not comparing, other modes need origins
+	// audit needs old values of deleted enrollments
+	full := compare || withOrigin || audit.enabled
+	originColumn := ""
+	if withOrigin {
+		originColumn = policy.column
+	}
+	fetchedEnrollments, err := store.enrollments(uidentity.UUID, projectSlug, originColumn)
+	fatalOnError(err)
 	var (
 		existingEnrollments []shEnrollment
-		existingEnrollment  shEnrollment
+		winningEnrollments  []shEnrollment
 	)
-	fatalOnError(err)
-	fetched = false
-	for rows.Next() {
-		if compare {
-			fatalOnError(
-				rows.Scan(
-					&existingEnrollment.UUID,
-					&existingEnrollment.OrgID,
-					&existingEnrollment.Start,
-					&existingEnrollment.End,
-					&existingEnrollment.ProjectSlug,
-				),
-			)
-			if mtx != nil {
-				mtx.RLock()
-			}
-			organization, ok := id2comp[existingEnrollment.OrgID]
-			if mtx != nil {
-				mtx.RUnlock()
-			}
-			if !ok {
-				fatalf("organization id %d not found", existingEnrollment.OrgID)
-			}
-			existingEnrollment.Organization = organization
-			existingEnrollments = append(existingEnrollments, existingEnrollment)
-		} else {
-			fatalOnError(rows.Scan(&uuid))
+	fetched := len(fetchedEnrollments) > 0
+	if !full {
+		fetchedEnrollments = nil
+	}
+	for _, existingEnrollment := range fetchedEnrollments {
+		if mtx != nil {
+			mtx.RLock()
 		}
-		fetched = true
-		if !compare {
-			break
+		organization, ok := id2comp[existingEnrollment.OrgID]
+		if mtx != nil {
+			mtx.RUnlock()
+		}
+		if !ok {
+			fatalf("organization id %d not found", existingEnrollment.OrgID)
+		}
+		existingEnrollment.Organization = organization
+		if withOrigin && policy.wins(existingEnrollment.Origin) {
+			winningEnrollments = append(winningEnrollments, existingEnrollment)
+		} else {
+			existingEnrollments = append(existingEnrollments, existingEnrollment)
 		}
 	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
 	getCompIds := func() {
 		for i, enrollment := range uidentity.Enrollments {
 			if mtx != nil {
@@ -1119,7 +1327,7 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 				mtx.RUnlock()
 			}
 			if !ok {
-				fmt.Printf("Enrollments: unknown oranization: %s in: %+v\n", enrollment.Organization, uidentity.Enrollments)
+				log.warn("enrollment with unknown organization", "org", enrollment.Organization, "enrollments", uidentity.Enrollments)
 				continue
 			}
 			uidentity.Enrollments[i].OrgID = orgID
@@ -1134,16 +1342,11 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 				continue
 			}
 			if org != enrollment.Organization {
-				if dbg {
-					fmt.Printf("updaing org name that would be mapped: '%s' -> '%s'\n", enrollment.Organization, org)
-				}
+				log.debug("updating org name that would be mapped", "org", enrollment.Organization, "to", org)
 				uidentity.Enrollments[i].Organization = org
 			}
 		}
 	}
-	if fetched {
-		sts.enrollmentsFound++
-	}
 	rolsString := func(rols []shEnrollment) string {
 		ary := []string{}
 		for _, rol := range rols {
@@ -1157,64 +1360,93 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 		}
 		return "[" + strings.Join(ary, ",") + "]"
 	}
+	if full {
+		fetched = len(existingEnrollments) > 0 || len(winningEnrollments) > 0
+	}
+	if fetched {
+		count("enrollments_found")
+	}
 	compIDCalculated := false
-	same = false
+	// enrollments from origins with higher precedence win, they're never touched and imported enrollments are skipped:
+	// when they're the same there is nothing to add, when they differ this is reported as a conflict
+	// import's own enrollments are then synced with no imported enrollments (deleted in replace mode)
+	if len(winningEnrollments) > 0 {
+		getCompIds()
+		compIDCalculated = true
+		if enrollmentsDiffer(uidentity.Enrollments, winningEnrollments) {
+			log.debug("enrollments owned by other origins take precedence", "enrollments", rolsString(uidentity.Enrollments), "existing", rolsString(winningEnrollments))
+			policy.conflict(uidentity, winningEnrollments, cResolutionKept)
+			count("enrollments_conflicts")
+		} else {
+			count("enrollments_same")
+		}
+		uidentity.Enrollments = nil
+		fetched = len(existingEnrollments) > 0
+		if !fetched {
+			return
+		}
+	}
+	same := false
 	if fetched && compare {
 		getCompIds()
 		compIDCalculated = true
 		same = !enrollmentsDiffer(uidentity.Enrollments, existingEnrollments)
 		if same {
-			sts.enrollmentsSame++
-		} else if dbg {
-			fmt.Printf("Enrollments differ: %+v != %+v\n", rolsString(uidentity.Enrollments), rolsString(existingEnrollments))
+			count("enrollments_same")
+		} else {
+			log.debug("enrollments differ", "enrollments", rolsString(uidentity.Enrollments), "existing", rolsString(existingEnrollments))
+		}
+	}
+	// enrollments from other origins that the import can override
+	otherEnrollments := []shEnrollment{}
+	for _, enrollment := range existingEnrollments {
+		if enrollment.Origin == nil || *enrollment.Origin != cOrigin {
+			otherEnrollments = append(otherEnrollments, enrollment)
 		}
 	}
+	if withOrigin && fetched && !same && !replace && len(otherEnrollments) > 0 {
+		policy.conflict(uidentity, otherEnrollments, cResolutionKept)
+		count("enrollments_conflicts")
+	}
 	// found, they differ (or compare mode is off) and replace mode is on
 	// delete them
-	// fmt.Printf("state (%v,%v,%v,%v)\n", fetched, same, compare, replace)
 	if fetched && !same && replace {
-		if dbg {
-			fmt.Printf("deleting enrollments for %s/%s\n", uidentity.UUID, *gProjectSlug)
-		}
-		if gProjectSlug == nil {
-			_, err := exec(db, "", "delete from enrollments where uuid = ? and project_slug is null", uidentity.UUID)
-			fatalOnError(err)
+		log.debug("deleting enrollments")
+		if !withOrigin {
+			fatalOnError(store.deleteEnrollments(uidentity.UUID, projectSlug))
+			for i := range existingEnrollments {
+				audit.enrollmentDeleted(store, &uidentity, &existingEnrollments[i])
+			}
 		} else {
-			_, err := exec(db, "", "delete from enrollments where uuid = ? and project_slug = ?", uidentity.UUID, *gProjectSlug)
-			fatalOnError(err)
+			for i, enrollment := range existingEnrollments {
+				fatalOnError(store.deleteEnrollment(enrollment.ID))
+				audit.enrollmentDeleted(store, &uidentity, &existingEnrollments[i])
+			}
+			if len(otherEnrollments) > 0 {
+				policy.conflict(uidentity, otherEnrollments, cResolutionReplaced)
+				count("enrollments_conflicts")
+			}
 		}
-		sts.enrollmentsDeleted++
+		count("enrollments_deleted")
 	}
 	// they differ (which means there are no rols, compare mode is off or they actually differ) and
 	// none fetched or some fetched and replace mode is on
 	// add them
 	if !same && (!fetched || (fetched && replace)) {
-		if dbg {
-			fmt.Printf("adding enrollments for %s/%s\n", uidentity.UUID, *gProjectSlug)
-		}
+		log.debug("adding enrollments")
 		if !compIDCalculated {
 			getCompIds()
 		}
 		for _, enrollment := range uidentity.Enrollments {
 			if enrollment.OrgID <= 0 {
-				sts.enrollmentsSkipped++
+				count("enrollments_skipped")
 				continue
 			}
-			if dbg {
-				fmt.Printf("adding enrollment for %s/%s/%s\n", uidentity.UUID, *gProjectSlug, enrollment.String())
-			}
-			_, err := exec(
-				db,
-				"",
-				"insert into enrollments(uuid, organization_id, start, end, project_slug) values(?,?,?,?,?)",
-				enrollment.UUID,
-				enrollment.OrgID,
-				enrollment.Start,
-				enrollment.End,
-				gProjectSlug,
-			)
+			log.debug("adding enrollment", "org", enrollment.Organization, "enrollment", enrollment.String())
+			err = store.addEnrollment(&enrollment, projectSlug, originColumn, cOrigin)
 			fatalOnError(err)
-			sts.enrollmentsAdded++
+			audit.enrollmentAdded(store, &uidentity, &enrollment)
+			count("enrollments_added")
 		}
 	}
 }
@@ -1270,22 +1502,86 @@ func getConnectString(prefix string) string {
 	return dsn
 }
 
-func main() {
-	// Connect to MariaDB
-	if len(os.Args) < 2 {
-		fmt.Printf("Arguments required: file.yaml\n")
-		return
+// connectStorage - connects to SortingHat GraphQL API when SH_GRAPHQL_URL is set, SQLite file when SH_SQLITE is set
+// or MariaDB database, returned function closes the connection
+func connectStorage() (shStorage, func()) {
+	url := os.Getenv("SH_GRAPHQL_URL")
+	if url != "" {
+		store, err := newGraphQLStorage(url)
+		fatalOnError(err)
+		return store, func() {}
 	}
-	dtStart := time.Now()
 	var db *sql.DB
-	dsn := getConnectString("SH_")
-	db, err := sql.Open("mysql", dsn)
-	fatalOnError(err)
-	defer func() { fatalOnError(db.Close()) }()
-	_, err = db.Exec("set @origin = ?", cOrigin)
+	path := os.Getenv("SH_SQLITE")
+	if path != "" {
+		db = openSQLite(path)
+		if os.Getenv("SH_SQLITE_CREATE") != "" {
+			fatalOnError(createSQLiteSchema(db))
+		}
+		return newSQLiteStorage(db), func() { fatalOnError(db.Close()) }
+	}
+	db, err := openMySQL(getConnectString("SH_"), cOrigin)
 	fatalOnError(err)
-	err = importYAMLfiles(db, os.Args[1:len(os.Args)])
+	configureDB(db)
+	pingDB(db)
+	return newMySQLStorage(db), func() { fatalOnError(db.Close()) }
+}
+
+func runHistory(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Arguments required: history uuid [uuid ...]\n")
+		return 2
+	}
+	store, closeStorage := connectStorage()
+	defer closeStorage()
+	for _, uuid := range args {
+		printHistory(store, uuid)
+	}
+	return 0
+}
+
+func runImport(args []string) int {
+	if len(args) == 0 && os.Getenv("PROJECTS_MANIFEST") == "" {
+		fmt.Fprintf(os.Stderr, "Arguments required: file.yaml [file2.yaml ...] (or PROJECTS_MANIFEST=manifest.yaml)\n")
+		return 2
+	}
+	gReportRun = true
+	dtStart := time.Now()
+	if !validationPreflight(inputFileNames(args)) {
+		fatalf("identities files are not valid, see validation errors (SKIP_VALIDATION=1 skips validation)")
+	}
+	store, closeStorage := connectStorage()
+	defer closeStorage()
+	if !schemaPreflight(store, importOriginColumn()) {
+		fatalf("SortingHat schema is not compatible with import, see schema check errors (SKIP_SCHEMA_CHECK=1 skips the check)")
+	}
+	fatalOnError(store.setOrigin(cOrigin))
+	gLog.info("starting import", "run_id", gRunID)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+	err := importYAMLfiles(ctx, store, args)
+	gStats.print()
+	if err == context.Canceled {
+		gLog.warn("import interrupted, partial reports written", "duration", time.Now().Sub(dtStart))
+		gSummary.addError(err)
+		reportRun(cStatusInterrupted, 1)
+		return 1
+	}
 	fatalOnError(err)
+	reportRun(cStatusSuccess, 0)
 	dtEnd := time.Now()
-	fmt.Printf("Time(%s): %v\n", os.Args[0], dtEnd.Sub(dtStart))
+	gLog.info("import finished", "duration", dtEnd.Sub(dtStart))
+	return 0
+}
+
+func main() {
+	gRunID = newRunID()
+	cmd, args, code := parseCommandLine(os.Args[1:])
+	if cmd != nil {
+		code = cmd.run(args)
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
 }
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// importCase - single import scenario run against in-memory SortingHat
+type importCase struct {
+	name    string
+	env     map[string]string
+	orgsMap string
+	input   string
+	// inputs - more input files (identities.yaml, identities2.yaml, ...) imported in this order, used instead of input
+	inputs   []string
+	manifest string
+	seed     func(st *memoryStorage)
+	check    func(st *memoryStorage) error
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// expectEnrollments - checks enrollments of a given uuid, see memoryStorage.describeEnrollments
+func expectEnrollments(st *memoryStorage, uuid string, expected ...string) error {
+	got := st.describeEnrollments(uuid)
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		return fmt.Errorf("%s enrollments: expected %v, got %v", uuid, expected, got)
+	}
+	return nil
+}
+
+func expectCounter(group, counter string, expected int) error {
+	got := gStats.get(group, counter)
+	if got != expected {
+		return fmt.Errorf("%s/%s: expected %d, got %d", group, counter, expected, got)
+	}
+	return nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedPeople - John Doe (u1), two people named Jane Roe (u2 and u3, only u3 has jane@roe.com email),
+// u4 with GitHub username jsmith; organizations Company A and Company B
+func seedPeople(st *memoryStorage) {
+	st.addPerson("u1", "John Doe")
+	st.addPerson("u2", "Jane Roe")
+	st.addPerson("u3", "Jane Roe", memoryIdentity{source: "git", name: "Jane Roe", email: strPtr("jane@roe.com")})
+	st.addPerson("u4", "J. Smith", memoryIdentity{source: "github", name: "J. Smith", username: "jsmith"})
+	st.addOrganization("Company A")
+	st.addOrganization("Company B")
+}
+
+var gImportCases = []importCase{
+	{
+		name: "match by name",
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/(nil)/null"),
+				expectCounter(cPhaseLookup, "found_by_name", 1),
+				expectCounter(cPhaseSync, "enrollments_added", 1),
+			)
+		},
+	},
+	{
+		name: "ambiguous name falls back to email",
+		input: `
+- profile:
+    name: Jane Roe
+  email:
+  - jane@roe.com
+  enrollments:
+  - organization: Company B
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u2"),
+				expectEnrollments(st, "u3", "Company B/(nil)/null"),
+				expectCounter(cPhaseLookup, "found_by_email", 1),
+			)
+		},
+	},
+	{
+		name: "match by source and username",
+		input: `
+- profile:
+    name: Joe Smith
+  github:
+  - jsmith
+  enrollments:
+  - organization: Company A
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u4", "Company A/(nil)/null"),
+				expectCounter(cPhaseLookup, "found_by_source_username", 1),
+			)
+		},
+	},
+	{
+		name: "ambiguous and missing profiles",
+		input: `
+- profile:
+    name: Jane Roe
+  enrollments:
+  - organization: Company A
+- profile:
+    name: Nobody
+  enrollments:
+  - organization: Company A
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u2"),
+				expectEnrollments(st, "u3"),
+				expectCounter(cPhaseLookup, "missing", 2),
+				expectCounter(cPhaseLookup, "ambiguous", 1),
+			)
+		},
+	},
+	{
+		name: "names are matched case and diacritics insensitive, other scripts are kept",
+		input: `
+- profile:
+    name: jose muller
+  enrollments:
+  - organization: company a
+- profile:
+    name: ИВАН ПЕТРОВ
+  enrollments:
+  - organization: Company A
+- profile:
+    name: 王小明
+  enrollments:
+  - organization: Company B
+- profile:
+    name: 李雷
+  enrollments:
+  - organization: Company B
+`,
+		seed: func(st *memoryStorage) {
+			st.addPerson("u1", "José Müller")
+			st.addPerson("u2", "Иван Петров")
+			st.addPerson("u3", "王小明")
+			st.addOrganization("Company A")
+			st.addOrganization("Company B")
+		},
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/(nil)/null"),
+				expectEnrollments(st, "u2", "Company A/(nil)/null"),
+				expectEnrollments(st, "u3", "Company B/(nil)/null"),
+				expectCounter(cPhaseLookup, "found_by_name", 3),
+				expectCounter(cPhaseLookup, "missing", 1),
+			)
+		},
+	},
+	{
+		name: "lookups neither collapse white space nor transliterate, like MariaDB collation",
+		input: `
+- profile:
+    name: Soren Kierkegaard
+  enrollments:
+  - organization: Company A
+- profile:
+    name: John  Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: func(st *memoryStorage) {
+			st.addPerson("u1", "Søren Kierkegaard")
+			st.addPerson("u2", "John Doe")
+			st.addOrganization("Company A")
+		},
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1"),
+				expectEnrollments(st, "u2"),
+				expectCounter(cPhaseLookup, "missing", 2),
+			)
+		},
+	},
+	{
+		name: "project slugs",
+		env:  map[string]string{"PROJECT_SLUG": "finos-f"},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+  - organization: Company B
+    project_slug: finos-f-perspective
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return expectEnrollments(st, "u1", "Company A/finos-f/null", "Company B/finos-f-perspective/null")
+		},
+	},
+	{
+		name:    "organizations mapping",
+		orgsMap: "mappings:\n- ['^acme', 'Company B']\n",
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: company a
+  - organization: ACME Corporation
+  - organization: Unknown Org
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/(nil)/null", "Company B/(nil)/null"),
+				expectCounter(cPhaseOrgMapping, "found_lower_case", 1),
+				expectCounter(cPhaseOrgMapping, "mapped", 1),
+				expectCounter(cPhaseOrgMapping, "missing", 1),
+				expectCounter(cPhaseSync, "enrollments_skipped", 1),
+			)
+		},
+	},
+	{
+		name: "compare: same enrollments are not touched",
+		env:  map[string]string{"COMPARE": "1", "REPLACE": "1", "OWNERSHIP": cOwnershipOwn},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: func(st *memoryStorage) {
+			seedPeople(st)
+			st.addExistingEnrollment("u1", 1, nil, strPtr(cOrigin))
+		},
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/(nil)/"+cOrigin),
+				expectCounter(cPhaseSync, "enrollments_same", 1),
+				expectCounter(cPhaseSync, "enrollments_deleted", 0),
+				expectCounter(cPhaseSync, "enrollments_added", 0),
+			)
+		},
+	},
+	{
+		name: "compare without replace keeps different enrollments",
+		env:  map[string]string{"COMPARE": "1", "OWNERSHIP": cOwnershipOwn},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: func(st *memoryStorage) {
+			seedPeople(st)
+			st.addExistingEnrollment("u1", 2, nil, strPtr(cOrigin))
+		},
+		check: func(st *memoryStorage) error {
+			return expectEnrollments(st, "u1", "Company B/(nil)/"+cOrigin)
+		},
+	},
+	{
+		name: "replace different enrollments",
+		env:  map[string]string{"COMPARE": "1", "REPLACE": "1", "OWNERSHIP": cOwnershipOwn},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: func(st *memoryStorage) {
+			seedPeople(st)
+			st.addExistingEnrollment("u1", 2, nil, strPtr(cOrigin))
+		},
+		check: func(st *memoryStorage) error {
+			entries, _ := st.auditEntries("u1")
+			actions := []string{}
+			for _, entry := range entries {
+				actions = append(actions, entry.Action)
+			}
+			if strings.Join(actions, ",") != cAuditEnrollmentDelete+","+cAuditEnrollmentAdd {
+				return fmt.Errorf("u1 audit: expected delete and add, got %v", actions)
+			}
+			return expectEnrollments(st, "u1", "Company A/(nil)/"+cOrigin)
+		},
+	},
+	{
+		name: "enrollments from other origins take precedence",
+		env:  map[string]string{"COMPARE": "1", "REPLACE": "1", "OWNERSHIP": cOwnershipOwn},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: func(st *memoryStorage) {
+			seedPeople(st)
+			st.addExistingEnrollment("u1", 2, nil, strPtr("affiliations-api"))
+		},
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company B/(nil)/affiliations-api"),
+				expectCounter(cPhaseSync, "enrollments_conflicts", 1),
+				expectCounter(cPhaseSync, "enrollments_added", 0),
+			)
+		},
+	},
+	{
+		name: "own enrollments are deleted when other origin takes precedence",
+		env:  map[string]string{"COMPARE": "1", "REPLACE": "1", "OWNERSHIP": cOwnershipOwn},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company B
+`,
+		seed: func(st *memoryStorage) {
+			seedPeople(st)
+			st.addExistingEnrollment("u1", 1, nil, strPtr(cOrigin))
+			st.addExistingEnrollment("u1", 2, nil, strPtr("affiliations-api"))
+		},
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company B/(nil)/affiliations-api"),
+				expectCounter(cPhaseSync, "enrollments_same", 1),
+				expectCounter(cPhaseSync, "enrollments_conflicts", 0),
+				expectCounter(cPhaseSync, "enrollments_deleted", 1),
+			)
+		},
+	},
+	{
+		name: "legacy ownership replaces other origins",
+		env:  map[string]string{"COMPARE": "1", "REPLACE": "1", "OWNERSHIP": cOwnershipAll},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+		seed: func(st *memoryStorage) {
+			seedPeople(st)
+			st.addExistingEnrollment("u1", 2, nil, strPtr("affiliations-api"))
+		},
+		check: func(st *memoryStorage) error {
+			return expectEnrollments(st, "u1", "Company A/(nil)/null")
+		},
+	},
+	{
+		name:     "files mapped to different project slugs are both imported",
+		manifest: "files:\n- file: identities.yaml\n  project_slugs: [finos]\n- file: identities2.yaml\n  project_slugs: [finos-perspective]\n",
+		inputs: []string{`
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`, `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`},
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/finos-perspective/null", "Company A/finos/null"),
+				expectCounter(cPhaseMerge, "conflicts", 0),
+			)
+		},
+	},
+	{
+		name: "file given later takes precedence within a project slug",
+		inputs: []string{`
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+  - organization: Company B
+    project_slug: finos-f
+`, `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company B
+`},
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company B/(nil)/null", "Company B/finos-f/null"),
+				expectCounter(cPhaseMerge, "conflicts", 1),
+			)
+		},
+	},
+	{
+		name: "union merge policy keeps enrollments from all files",
+		env:  map[string]string{"MERGE_POLICY": cMergeUnion},
+		inputs: []string{`
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`, `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company B
+`},
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/(nil)/null", "Company B/(nil)/null"),
+				expectCounter(cPhaseMerge, "conflicts", 1),
+			)
+		},
+	},
+	{
+		name: "duplicates in a file are merged",
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+- profile:
+    name: john doe
+  enrollments:
+  - organization: Company B
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1", "Company A/(nil)/null", "Company B/(nil)/null"),
+				expectCounter(cPhaseLookup, "duplicates", 1),
+			)
+		},
+	},
+	{
+		name: "duplicates in a file are rejected",
+		env:  map[string]string{"DUPLICATES_POLICY": cDuplicatesReject},
+		input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+- profile:
+    name: john doe
+  enrollments:
+  - organization: Company B
+- profile:
+    name: J. Smith
+  enrollments:
+  - organization: Company B
+`,
+		seed: seedPeople,
+		check: func(st *memoryStorage) error {
+			return firstError(
+				expectEnrollments(st, "u1"),
+				expectEnrollments(st, "u4", "Company B/(nil)/null"),
+				expectCounter(cPhaseLookup, "duplicates", 1),
+			)
+		},
+	},
+}
+
+// importIsolated - imports files in a given directory (import writes reports into current directory)
+// All settings except logging ones are cleared, only given ones (and ORDERED=1) are used, fatal errors are returned as errors
+// Every import gets its own run summary, fatalOnError reports the run before panicking, so a failed import doesn't affect the next ones
+func importIsolated(dir string, env map[string]string, store shStorage, fileNames []string) (err error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	saved := make(map[string]*string)
+	defer func() {
+		for env, value := range saved {
+			if value == nil {
+				_ = os.Unsetenv(env)
+			} else {
+				_ = os.Setenv(env, *value)
+			}
+		}
+		_ = os.Chdir(cwd)
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("import failed: %v", r)
+		}
+	}()
+	for _, s := range gSettings {
+		if s.group == cGroupLog {
+			continue
+		}
+		value, ok := os.LookupEnv(s.env)
+		if ok {
+			saved[s.env] = &value
+		} else {
+			saved[s.env] = nil
+		}
+		fatalOnError(os.Unsetenv(s.env))
+	}
+	fatalOnError(os.Setenv("ORDERED", "1"))
+	for env, value := range env {
+		if _, ok := saved[env]; !ok {
+			value, ok := os.LookupEnv(env)
+			if ok {
+				saved[env] = &value
+			} else {
+				saved[env] = nil
+			}
+		}
+		fatalOnError(os.Setenv(env, value))
+	}
+	fatalOnError(os.Chdir(dir))
+	gProjectSlug = nil
+	gSummary = newRunSummary()
+	gReportOnce = &sync.Once{}
+	gReportRun = true
+	err = importYAMLfiles(context.Background(), store, fileNames)
+	return
+}
+
+// runImportCase - runs a single scenario in its own directory
+func runImportCase(dir string, tc *importCase) error {
+	env := make(map[string]string)
+	for k, v := range tc.env {
+		env[k] = v
+	}
+	if tc.orgsMap != "" {
+		fn := filepath.Join(dir, "map_org_names.yaml")
+		err := ioutil.WriteFile(fn, []byte(tc.orgsMap), 0644)
+		if err != nil {
+			return err
+		}
+		env["ORGS_MAP_FILE"] = fn
+	}
+	if tc.manifest != "" {
+		fn := filepath.Join(dir, "projects.yaml")
+		err := ioutil.WriteFile(fn, []byte(tc.manifest), 0644)
+		if err != nil {
+			return err
+		}
+		env["PROJECTS_MANIFEST"] = fn
+	}
+	inputs := tc.inputs
+	if len(inputs) == 0 {
+		inputs = []string{tc.input}
+	}
+	fileNames := []string{}
+	for i, input := range inputs {
+		fn := filepath.Join(dir, "identities.yaml")
+		if i > 0 {
+			fn = filepath.Join(dir, fmt.Sprintf("identities%d.yaml", i+1))
+		}
+		err := ioutil.WriteFile(fn, []byte(strings.TrimLeft(input, "\n")), 0644)
+		if err != nil {
+			return err
+		}
+		fileNames = append(fileNames, fn)
+	}
+	st := newMemoryStorage()
+	tc.seed(st)
+	err := importIsolated(dir, env, st, fileNames)
+	if err != nil {
+		return err
+	}
+	return tc.check(st)
+}
+
+// TestMain - logs only errors unless LOG_LEVEL (or DEBUG, DEBUG_SQL) is set
+func TestMain(m *testing.M) {
+	gRunID = newRunID()
+	configureLogging()
+	if os.Getenv("LOG_LEVEL") == "" && os.Getenv("DEBUG") == "" && os.Getenv("DEBUG_SQL") == "" {
+		gLogLevel = cLevelError
+	}
+	os.Exit(m.Run())
+}
+
+// TestImport - import scenarios against in-memory SortingHat, no database needed
+func TestImport(t *testing.T) {
+	for i := range gImportCases {
+		tc := &gImportCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			err := runImportCase(t.TempDir(), tc)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestImportIsolatedFailure - failed import is reported in its own run summary, the next import starts with a clean one
+func TestImportIsolatedFailure(t *testing.T) {
+	err := importIsolated(t.TempDir(), nil, newMemoryStorage(), []string{"missing.yaml"})
+	if err == nil {
+		t.Fatal("import of a missing file should fail")
+	}
+	if gSummary.Status != cStatusFailed || len(gSummary.Errors) != 1 {
+		t.Fatalf("failed import summary: status '%s', errors %v", gSummary.Status, gSummary.Errors)
+	}
+	err = runImportCase(t.TempDir(), &gImportCases[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gSummary.Status != "" || len(gSummary.Errors) != 0 {
+		t.Fatalf("next import summary: status '%s', errors %v", gSummary.Status, gSummary.Errors)
+	}
+}
+
+// TestReportRunOnlyImport - commands other than import don't write run summary (or metrics) even when they fail
+func TestReportRunOnlyImport(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(cwd)
+		gReportRun = true
+	}()
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gSummary = newRunSummary()
+	gReportOnce = &sync.Once{}
+	gReportRun = false
+	reportRun(cStatusFailed, 2)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 || gSummary.Status != "" {
+		t.Fatalf("run should not be reported, status '%s', files %d", gSummary.Status, len(files))
+	}
+	gReportRun = true
+	reportRun(cStatusFailed, 2)
+	_, err = os.Stat(filepath.Join(dir, cSummaryFile+"_"+gRunID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// log levels, SQL is the most verbose one
+const (
+	cLevelSQL = iota
+	cLevelDebug
+	cLevelInfo
+	cLevelWarn
+	cLevelError
+)
+
+const (
+	cLogFormatLogfmt = "logfmt"
+	cLogFormatJSON   = "json"
+)
+
+var (
+	gLogLevel     = cLevelInfo
+	gLogFormat    = cLogFormatLogfmt
+	gRedactEmails bool
+	gLog          = &logger{}
+	gLevelNames   = []string{"sql", "debug", "info", "warn", "error"}
+	gEmailRegexp  = regexp.MustCompile(`[^\s@<>"'(),;:\[\]{}]+@([A-Za-z0-9-]+\.[A-Za-z0-9.-]+)`)
+)
+
+// logger - structured leveled logger, every line has message and key/value fields
+// Loggers derived via with() carry additional fields (uuid, org, phase, ...), into() redirects output into
+// item's ordered output (see orderedOutput), so in ordered mode log lines are printed in items order
+type logger struct {
+	fields []interface{}
+	item   *itemLog
+}
+
+// configureLogging - LOG_LEVEL: sql, debug, info (default), warn, error; DEBUG=1 means debug, DEBUG_SQL=1 means sql
+// LOG_FORMAT: logfmt (default) or json, LOG_REDACT_EMAILS=1 replaces emails local parts with "***"
+func configureLogging() {
+	level := strings.ToLower(os.Getenv("LOG_LEVEL"))
+	if level == "" {
+		level = "info"
+		if os.Getenv("DEBUG") != "" {
+			level = "debug"
+		}
+		if os.Getenv("DEBUG_SQL") != "" {
+			level = "sql"
+		}
+	}
+	found := false
+	for i, name := range gLevelNames {
+		if name == level {
+			gLogLevel = i
+			found = true
+			break
+		}
+	}
+	if !found {
+		fatalf("unknown LOG_LEVEL '%s', allowed: %s", level, strings.Join(gLevelNames, ", "))
+	}
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	if format != "" {
+		if format != cLogFormatLogfmt && format != cLogFormatJSON {
+			fatalf("unknown LOG_FORMAT '%s', allowed: %s, %s", format, cLogFormatLogfmt, cLogFormatJSON)
+		}
+		gLogFormat = format
+	}
+	gRedactEmails = os.Getenv("LOG_REDACT_EMAILS") != ""
+}
+
+// with - returns logger with additional key/value fields
+func (l *logger) with(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{fields: fields, item: l.item}
+}
+
+// into - returns logger writing into a given item's output
+func (l *logger) into(item *itemLog) *logger {
+	return &logger{fields: l.fields, item: item}
+}
+
+func (l *logger) enabled(level int) bool {
+	return level >= gLogLevel
+}
+
+func (l *logger) sql(msg string, kv ...interface{})   { l.log(cLevelSQL, msg, kv) }
+func (l *logger) debug(msg string, kv ...interface{}) { l.log(cLevelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.log(cLevelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.log(cLevelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.log(cLevelError, msg, kv) }
+
+func redact(s string) string {
+	if !gRedactEmails {
+		return s
+	}
+	return gEmailRegexp.ReplaceAllString(s, "***@$1")
+}
+
+// logValue - returns value to log, numbers and bools are kept, everything else is converted to (redacted) string
+func logValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		return value
+	case nil:
+		return nil
+	case string:
+		return redact(value)
+	case error:
+		return redact(value.Error())
+	case time.Duration:
+		return value.String()
+	case *string:
+		if value == nil {
+			return nil
+		}
+		return redact(*value)
+	case fmt.Stringer:
+		return redact(value.String())
+	}
+	return redact(fmt.Sprintf("%+v", v))
+}
+
+func logfmtValue(v interface{}) string {
+	if v == nil {
+		return "null"
+	}
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprintf("%v", v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\n\r") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *logger) log(level int, msg string, kv []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	// in ordered mode logs of two runs on the same input must be the same, so no time and run ID
+	keys := []string{}
+	values := []interface{}{}
+	if !gOrdered {
+		keys = append(keys, "time")
+		values = append(values, time.Now().UTC().Format(time.RFC3339Nano))
+	}
+	keys = append(keys, "level")
+	values = append(values, gLevelNames[level])
+	if !gOrdered && gRunID != "" {
+		keys = append(keys, "run_id")
+		values = append(values, gRunID)
+	}
+	keys = append(keys, "msg")
+	values = append(values, redact(msg))
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprintf("%v", fields[i])
+		var value interface{}
+		if i+1 < len(fields) {
+			value = logValue(fields[i+1])
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	var buf bytes.Buffer
+	if gLogFormat == cLogFormatJSON {
+		buf.WriteString("{")
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(values[i])
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprintf("%v", values[i]))
+			}
+			buf.Write(k)
+			buf.WriteString(":")
+			buf.Write(v)
+		}
+		buf.WriteString("}\n")
+	} else {
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(key)
+			buf.WriteString("=")
+			buf.WriteString(logfmtValue(values[i]))
+		}
+		buf.WriteString("\n")
+	}
+	if l.item != nil {
+		l.item.printf("%s", buf.String())
+		return
+	}
+	fmt.Print(buf.String())
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// memoryIdentity - identity row, nil email means null
+type memoryIdentity struct {
+	uuid     string
+	source   string
+	name     string
+	email    *string
+	username string
+}
+
+// memoryStorage - in-memory SortingHat, used to test import without a database (see TestImport in import_test.go)
+// Organization mapping regular expressions are Go regular expressions matched case insensitively,
+// so they behave like MariaDB regexp on a case insensitive collation
+type memoryStorage struct {
+	mtx         *sync.Mutex
+	origin      string
+	uidentities map[string]struct{}
+	profiles    map[string]shProfile
+	identities  []memoryIdentity
+	orgs        map[int]string
+	rols        []shEnrollment
+	audit       []auditEntry
+	nextID      int
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		mtx:         &sync.Mutex{},
+		uidentities: make(map[string]struct{}),
+		profiles:    make(map[string]shProfile),
+		orgs:        make(map[int]string),
+	}
+}
+
+// addPerson - adds uidentity with its profile and identities
+func (s *memoryStorage) addPerson(uuid, name string, identities ...memoryIdentity) {
+	s.addProfile(shProfile{UUID: uuid, Name: name}, identities...)
+}
+
+// addProfile - adds uidentity with a given profile and identities
+func (s *memoryStorage) addProfile(profile shProfile, identities ...memoryIdentity) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.uidentities[profile.UUID] = struct{}{}
+	s.profiles[profile.UUID] = profile
+	for _, identity := range identities {
+		identity.uuid = profile.UUID
+		s.identities = append(s.identities, identity)
+	}
+}
+
+// addOrganization - adds organization and returns its id
+func (s *memoryStorage) addOrganization(name string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.nextID++
+	s.orgs[s.nextID] = name
+	return s.nextID
+}
+
+// addExistingEnrollment - adds enrollment that already exists before import, with default dates
+func (s *memoryStorage) addExistingEnrollment(uuid string, orgID int, projectSlug, origin *string) {
+	s.addEnrollmentRow(shEnrollment{UUID: uuid, OrgID: orgID, Start: gDefaultStartDate, End: gDefaultEndDate, ProjectSlug: projectSlug, Origin: origin})
+}
+
+// addEnrollmentRow - adds enrollment that already exists before import
+func (s *memoryStorage) addEnrollmentRow(enrollment shEnrollment) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.nextID++
+	enrollment.ID = s.nextID
+	s.rols = append(s.rols, enrollment)
+}
+
+// describeEnrollments - sorted "organization/project slug/origin" of all enrollments of a given uuid
+func (s *memoryStorage) describeEnrollments(uuid string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	descs := []string{}
+	for _, enrollment := range s.rols {
+		if enrollment.UUID != uuid {
+			continue
+		}
+		origin := "null"
+		if enrollment.Origin != nil {
+			origin = *enrollment.Origin
+		}
+		descs = append(descs, s.orgs[enrollment.OrgID]+"/"+slugKey(enrollment.ProjectSlug)+"/"+origin)
+	}
+	sort.Strings(descs)
+	return descs
+}
+
+func (s *memoryStorage) setOrigin(origin string) error {
+	s.mtx.Lock()
+	s.origin = origin
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *memoryStorage) profileUUIDs(name string) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	uuids := make(map[string]struct{})
+	for uuid, profile := range s.profiles {
+		if sameLookupKey(profile.Name, name) {
+			uuids[uuid] = struct{}{}
+		}
+	}
+	return firstKeys(uuids, 2), nil
+}
+
+func (s *memoryStorage) identityUUIDs(q identityQuery) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	uuids := make(map[string]struct{})
+	for _, identity := range s.identities {
+		if q.name != nil && !sameLookupKey(identity.name, *q.name) {
+			continue
+		}
+		if q.source != nil && identity.source != *q.source {
+			continue
+		}
+		if q.username != nil && !sameLookupKey(identity.username, *q.username) {
+			continue
+		}
+		if q.email != nil && (identity.email == nil || !sameLookupKey(*identity.email, *q.email)) {
+			continue
+		}
+		uuids[identity.uuid] = struct{}{}
+	}
+	return firstKeys(uuids, 2), nil
+}
+
+func (s *memoryStorage) organizations() (map[int]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	orgs := make(map[int]string)
+	for id, name := range s.orgs {
+		orgs[id] = name
+	}
+	return orgs, nil
+}
+
+func (s *memoryStorage) matchesRegexp(str, re string) (bool, error) {
+	return matchesRegexpCI(str, re)
+}
+
+func (s *memoryStorage) uidentityExists(uuid string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.uidentities[uuid]
+	return ok, nil
+}
+
+func (s *memoryStorage) profile(uuid string) (*shProfile, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	profile, ok := s.profiles[uuid]
+	if !ok {
+		return nil, nil
+	}
+	return &profile, nil
+}
+
+func (s *memoryStorage) updateProfile(profile *shProfile, fields []string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	existing, ok := s.profiles[profile.UUID]
+	if !ok {
+		return fmt.Errorf("profile %s not found", profile.UUID)
+	}
+	for _, name := range fields {
+		if name == "is_bot" {
+			existing.IsBot = profile.IsBot
+			continue
+		}
+		for _, field := range gProfileFields {
+			if field.name == name {
+				field.set(&existing, field.get(profile))
+			}
+		}
+	}
+	s.profiles[profile.UUID] = existing
+	return nil
+}
+
+func (s *memoryStorage) identityEmail(uuid, source, username string) (string, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, identity := range s.identities {
+		if identity.uuid == uuid && identity.source == source && sameLookupKey(identity.username, username) && identity.email != nil {
+			return *identity.email, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func sameSlug(slug1, slug2 *string) bool {
+	if slug1 == nil || slug2 == nil {
+		return slug1 == nil && slug2 == nil
+	}
+	return *slug1 == *slug2
+}
+
+func (s *memoryStorage) enrollments(uuid string, projectSlug *string, originColumn string) (enrollments []shEnrollment, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, enrollment := range s.rols {
+		if enrollment.UUID != uuid || !sameSlug(enrollment.ProjectSlug, projectSlug) {
+			continue
+		}
+		if originColumn == "" {
+			enrollment.Origin = nil
+		}
+		enrollments = append(enrollments, enrollment)
+	}
+	return
+}
+
+func (s *memoryStorage) deleteEnrollments(uuid string, projectSlug *string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	enrollments := []shEnrollment{}
+	for _, enrollment := range s.rols {
+		if enrollment.UUID != uuid || !sameSlug(enrollment.ProjectSlug, projectSlug) {
+			enrollments = append(enrollments, enrollment)
+		}
+	}
+	s.rols = enrollments
+	return nil
+}
+
+func (s *memoryStorage) deleteEnrollment(id int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, enrollment := range s.rols {
+		if enrollment.ID == id {
+			s.rols = append(s.rols[:i], s.rols[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) addEnrollment(enrollment *shEnrollment, projectSlug *string, originColumn, origin string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.orgs[enrollment.OrgID]
+	if !ok {
+		return fmt.Errorf("foreign key constraint fails: organization id %d", enrollment.OrgID)
+	}
+	s.nextID++
+	rol := *enrollment
+	rol.ID = s.nextID
+	rol.Organization = ""
+	rol.ProjectSlug = projectSlug
+	rol.Origin = nil
+	if originColumn != "" {
+		o := origin
+		rol.Origin = &o
+	}
+	s.rols = append(s.rols, rol)
+	return nil
+}
+
+func (s *memoryStorage) ensureAuditTable() error {
+	return nil
+}
+
+func (s *memoryStorage) addAuditEntry(entry *auditEntry) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.nextID++
+	e := *entry
+	e.ID = s.nextID
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memoryStorage) auditEntries(uuid string) (entries []auditEntry, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, entry := range s.audit {
+		if entry.UUID == uuid {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return
+}
+
+func (s *memoryStorage) schema(tables []string) (map[string]*tableSchema, error) {
+	return nil, nil
+}
+
+func (s *memoryStorage) hasProjectSlugs() bool {
+	return true
+}
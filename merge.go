@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	cMergeOrder       = "order"
+	cMergeNewest      = "newest"
+	cMergeUnion       = "union"
+	cDuplicatesMerge  = "merge"
+	cDuplicatesReject = "reject"
+)
+
+// mergeConflict - the same person (uuid) defined differently in more than one place
+type mergeConflict struct {
+	uuid       string
+	winner     shUIdentity
+	loser      shUIdentity
+	resolution string
+}
+
+func uidentitiesDiffer(u1, u2 *shUIdentity) bool {
+	return profilesDiffer(&u1.Profile, &u2.Profile) || enrollmentsDiffer(u1.Enrollments, u2.Enrollments)
+}
+
+// mergeUIdentity - returns union of two identities data, u1 profile and source are used
+func mergeUIdentity(u1, u2 shUIdentity) (u shUIdentity) {
+	u = u1
+	u.Enrollments = []shEnrollment{}
+	rols := make(map[string]struct{})
+	for _, enrollments := range [][]shEnrollment{u1.Enrollments, u2.Enrollments} {
+		for _, enrollment := range enrollments {
+			key := enrollment.String()
+			_, ok := rols[key]
+			if ok {
+				continue
+			}
+			rols[key] = struct{}{}
+			u.Enrollments = append(u.Enrollments, enrollment)
+		}
+	}
+	u.Emails = []string{}
+	emails := make(map[string]struct{})
+	for _, email := range append(append([]string{}, u1.Emails...), u2.Emails...) {
+		key := normalizeKey(email)
+		_, ok := emails[key]
+		if ok {
+			continue
+		}
+		emails[key] = struct{}{}
+		u.Emails = append(u.Emails, email)
+	}
+	u.Idents = make(map[string][]string)
+	for _, idents := range []map[string][]string{u1.Idents, u2.Idents} {
+		for source, userNames := range idents {
+			for _, userName := range userNames {
+				found := false
+				for _, existing := range u.Idents[source] {
+					if sameKey(existing, userName) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					u.Idents[source] = append(u.Idents[source], userName)
+				}
+			}
+		}
+	}
+	return
+}
+
+// slugEnrollments - enrollments grouped by project slug (see slugKey)
+func slugEnrollments(rols []shEnrollment) map[string][]shEnrollment {
+	slugs := make(map[string][]shEnrollment)
+	for _, rol := range rols {
+		slug := slugKey(rol.ProjectSlug)
+		slugs[slug] = append(slugs[slug], rol)
+	}
+	return slugs
+}
+
+// slugsDiffer - enrollments differ within a project slug both identities have enrollments for
+func slugsDiffer(u1, u2 *shUIdentity) bool {
+	slugs2 := slugEnrollments(u2.Enrollments)
+	for slug, rols1 := range slugEnrollments(u1.Enrollments) {
+		rols2, ok := slugs2[slug]
+		if ok && enrollmentsDiffer(rols1, rols2) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSlugs - returns u1 with u2 enrollments of project slugs u1 has no enrollments for added
+// files mapped to different project slugs complement each other, precedence only decides within a project slug
+func mergeSlugs(u1, u2 shUIdentity) (u shUIdentity) {
+	u = u1
+	slugs := slugEnrollments(u1.Enrollments)
+	u.Enrollments = append([]shEnrollment{}, u1.Enrollments...)
+	for _, rol := range u2.Enrollments {
+		_, ok := slugs[slugKey(rol.ProjectSlug)]
+		if !ok {
+			u.Enrollments = append(u.Enrollments, rol)
+		}
+	}
+	return
+}
+
+// mergeFiles - merges the same person (by resolved uuid) appearing in multiple input files
+// Enrollments of different project slugs are always kept, policy decides profile and enrollments within a project slug
+// MERGE_POLICY:
+// "order" (default) - files given later take precedence
+// "newest" - most recently modified file takes precedence
+// "union" - enrollments, emails and identities from all files are merged, profile is taken from file given later
+func mergeFiles(fileNames []string, filesUIdentities []map[string]shUIdentity) (uidentities map[string]shUIdentity, conflicts []mergeConflict) {
+	policy := os.Getenv("MERGE_POLICY")
+	if policy == "" {
+		policy = cMergeOrder
+	}
+	if policy != cMergeOrder && policy != cMergeNewest && policy != cMergeUnion {
+		fatalf("unknown MERGE_POLICY '%s', allowed: %s, %s, %s", policy, cMergeOrder, cMergeNewest, cMergeUnion)
+	}
+	// files sorted from the lowest precedence
+	order := []int{}
+	for i := range fileNames {
+		order = append(order, i)
+	}
+	if policy == cMergeNewest {
+		modified := make([]int64, len(fileNames))
+		for i, fileName := range fileNames {
+			info, err := os.Stat(fileName)
+			fatalOnError(err)
+			modified[i] = info.ModTime().UnixNano()
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return modified[order[i]] < modified[order[j]]
+		})
+	}
+	uidentities = make(map[string]shUIdentity)
+	for _, i := range order {
+		for uuid, uidentity := range filesUIdentities[i] {
+			existing, ok := uidentities[uuid]
+			if !ok {
+				uidentities[uuid] = mergeSlugs(uidentity, existing)
+				continue
+			}
+			if !uidentitiesDiffer(&uidentity, &existing) {
+				continue
+			}
+			if policy == cMergeUnion {
+				uidentities[uuid] = mergeUIdentity(uidentity, existing)
+				conflicts = append(conflicts, mergeConflict{uuid: uuid, winner: uidentity, loser: existing, resolution: "merged"})
+				continue
+			}
+			uidentities[uuid] = mergeSlugs(uidentity, existing)
+			if profilesDiffer(&uidentity.Profile, &existing.Profile) || slugsDiffer(&uidentity, &existing) {
+				conflicts = append(conflicts, mergeConflict{uuid: uuid, winner: uidentity, loser: existing, resolution: "replaced by " + policy})
+			}
+		}
+	}
+	return
+}
+
+// saveMergeConflicts - saves conflicts between definitions of the same person into a CSV file
+func saveMergeConflicts(fileName string, conflicts []mergeConflict) {
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		return conflicts[i].uuid < conflicts[j].uuid
+	})
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"UUID", "Name", "Resolution", "Source", "Enrollments", "Other Source", "Other Enrollments"}))
+	rolsString := func(rols []shEnrollment) string {
+		ary := []string{}
+		for _, rol := range rols {
+			ary = append(ary, fmt.Sprintf("%s from:%s to:%s project:%s", rol.Organization, toYMDDate(rol.Start), toYMDDate(rol.End), slugKey(rol.ProjectSlug)))
+		}
+		sort.Strings(ary)
+		return strings.Join(ary, ",")
+	}
+	for _, conflict := range conflicts {
+		fatalOnError(writer.Write(
+			[]string{
+				conflict.uuid,
+				conflict.winner.Profile.Name,
+				conflict.resolution,
+				conflict.winner.source(),
+				rolsString(conflict.winner.Enrollments),
+				conflict.loser.source(),
+				rolsString(conflict.loser.Enrollments),
+			},
+		))
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
+}
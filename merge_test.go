@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMergeFilesNewest - most recently modified file takes precedence within a project slug, other project slugs are kept
+func TestMergeFilesNewest(t *testing.T) {
+	dir := t.TempDir()
+	fileNames := []string{filepath.Join(dir, "newer.yaml"), filepath.Join(dir, "older.yaml")}
+	for i, fn := range fileNames {
+		err := ioutil.WriteFile(fn, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-time.Duration(i) * time.Hour)
+		err = os.Chtimes(fn, modified, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	person := func(source string, rols ...shEnrollment) map[string]shUIdentity {
+		return map[string]shUIdentity{"u1": {UUID: "u1", Profile: shProfile{Name: "John Doe"}, Enrollments: rols, SourceFile: source}}
+	}
+	newer := shEnrollment{UUID: "u1", Organization: "Company A", Start: gDefaultStartDate, End: gDefaultEndDate}
+	older := newer
+	older.Organization = "Company B"
+	perspective := newer
+	perspective.ProjectSlug = strPtr("finos-perspective")
+	_ = os.Setenv("MERGE_POLICY", cMergeNewest)
+	defer func() { _ = os.Unsetenv("MERGE_POLICY") }()
+	uidentities, conflicts := mergeFiles(fileNames, []map[string]shUIdentity{person("newer", newer), person("older", older, perspective)})
+	if len(conflicts) != 1 || conflicts[0].winner.SourceFile != "newer" {
+		t.Fatalf("expected single conflict won by newer file, got %+v", conflicts)
+	}
+	rols := uidentities["u1"].Enrollments
+	if len(rols) != 2 || enrollmentsDiffer(rols, []shEnrollment{newer, perspective}) {
+		t.Fatalf("expected enrollments %v and %v, got %+v", newer, perspective, rols)
+	}
+}
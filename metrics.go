@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cMetricsPrefix     = "import_finos_identities_"
+	cMetricLastSuccess = cMetricsPrefix + "last_success_timestamp_seconds"
+)
+
+// metric - single gauge sample in Prometheus text exposition format
+type metric struct {
+	name   string
+	help   string
+	labels string
+	value  float64
+}
+
+// runMetrics - metrics of a finished run
+func runMetrics(s *runSummary) (metrics []metric) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	add := func(name, help, labels string, value float64) {
+		metrics = append(metrics, metric{name: cMetricsPrefix + name, help: help, labels: labels, value: value})
+	}
+	counter := func(group, name string) float64 {
+		return float64(s.Phases[group].Counters[name])
+	}
+	success := 0.0
+	if s.Status == cStatusSuccess {
+		success = 1.0
+	}
+	add("success", "1 if the last run succeeded, 0 otherwise", "", success)
+	add("exit_code", "Exit code of the last run", "", float64(s.ExitCode))
+	add("duration_seconds", "Duration of the last run", "", s.DurationSeconds)
+	add("errors", "Number of errors in the last run", "", float64(len(s.Errors)))
+	add("input_files", "Number of input files imported", "", float64(len(s.Inputs)))
+	add("records_processed", "Number of records read from input files", "", counter(cPhaseParse, "records"))
+	add("profiles_matched", "Number of profiles matched to existing uuids", "", counter(cPhaseLookup, "found"))
+	add("profiles_missing", "Number of profiles not found in the database", "", float64(s.MissingProfiles))
+	add("profiles_ambiguous", "Number of profiles matching more than one uuid", "", float64(s.AmbiguousProfiles))
+	add("orgs_missing", "Number of organizations not found in the database", "", float64(s.MissingOrgs))
+	groups := []string{}
+	for group := range s.Phases {
+		if strings.HasPrefix(group, cPhaseSync+":") {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	// enrollments are only reported per project slug, sum over project_slug is the total
+	// a run without enrollments sync still reports them, with an empty project slug
+	for _, action := range []string{"added", "deleted", "skipped"} {
+		name := "enrollments_" + action
+		help := fmt.Sprintf("Number of enrollments %s per project slug", action)
+		if len(groups) == 0 {
+			add(name, help, `{project_slug=""}`, counter(cPhaseSync, name))
+		}
+		for _, group := range groups {
+			slug := strings.TrimPrefix(group, cPhaseSync+":")
+			add(name, help, fmt.Sprintf(`{project_slug="%s"}`, strings.Replace(slug, `"`, `\"`, -1)), counter(group, name))
+		}
+	}
+	for _, group := range sortedPhases(s.Phases) {
+		phase := s.Phases[group]
+		if phase.DurationSeconds != nil {
+			add("phase_duration_seconds", "Duration of the import phase in the last run", fmt.Sprintf(`{phase="%s"}`, group), *phase.DurationSeconds)
+		}
+	}
+	if success > 0 {
+		add("last_success_timestamp_seconds", "Unix time of the last successful run", "", float64(s.Finished.Unix()))
+	}
+	return
+}
+
+func sortedPhases(phases map[string]summaryPhase) (keys []string) {
+	for key := range phases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// formatMetrics - formats metrics in Prometheus text exposition format, HELP/TYPE is written once per metric name
+func formatMetrics(metrics []metric) []byte {
+	var buf bytes.Buffer
+	described := make(map[string]struct{})
+	for _, m := range metrics {
+		_, ok := described[m.name]
+		if !ok {
+			fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+			described[m.name] = struct{}{}
+		}
+		fmt.Fprintf(&buf, "%s%s %v\n", m.name, m.labels, m.value)
+	}
+	return buf.Bytes()
+}
+
+// previousLastSuccess - reads last success timestamp from existing textfile, so failed runs don't reset it
+func previousLastSuccess(fileName string) (line string) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), cMetricLastSuccess+" ") {
+			line = scanner.Text()
+		}
+	}
+	return
+}
+
+// writeMetricsTextfile - writes metrics for node_exporter textfile collector, file is replaced atomically
+func writeMetricsTextfile(fileName string, metrics []metric) error {
+	data := formatMetrics(metrics)
+	hasLastSuccess := false
+	for _, m := range metrics {
+		if m.name == cMetricLastSuccess {
+			hasLastSuccess = true
+			break
+		}
+	}
+	if !hasLastSuccess {
+		line := previousLastSuccess(fileName)
+		if line != "" {
+			data = append(data, []byte(fmt.Sprintf("# HELP %s Unix time of the last successful run\n# TYPE %s gauge\n%s\n", cMetricLastSuccess, cMetricLastSuccess, line))...)
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// pushMetrics - pushes metrics to a Pushgateway-compatible URL
+// POST only replaces metrics with the same names, so last success timestamp survives failed runs
+func pushMetrics(url, job string, metrics []metric) error {
+	url = strings.TrimRight(url, "/") + "/metrics/job/" + job
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(formatMetrics(metrics)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	// not using getEnvDuration: it can fail and this is called from fatalOnError
+	timeout, err := time.ParseDuration(os.Getenv("METRICS_PUSH_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("push to %s failed: %s: %s", url, resp.Status, string(body))
+	}
+	return nil
+}
+
+// exportMetrics - exports run metrics into METRICS_TEXTFILE and/or pushes them to METRICS_PUSH_URL
+// Monitoring failures are reported but they never fail the import
+func exportMetrics(s *runSummary) {
+	textfile := os.Getenv("METRICS_TEXTFILE")
+	pushURL := os.Getenv("METRICS_PUSH_URL")
+	if textfile == "" && pushURL == "" {
+		return
+	}
+	metrics := runMetrics(s)
+	if textfile != "" {
+		err := writeMetricsTextfile(textfile, metrics)
+		if err != nil {
+			gLog.error("cannot write metrics", "file", textfile, "error", err)
+		} else {
+			gLog.info("metrics saved", "file", textfile)
+		}
+	}
+	if pushURL != "" {
+		job := os.Getenv("METRICS_JOB")
+		if job == "" {
+			job = "import_finos_identities"
+		}
+		err := pushMetrics(pushURL, job, metrics)
+		if err != nil {
+			gLog.error("cannot push metrics", "url", pushURL, "error", err)
+		} else {
+			gLog.info("metrics pushed", "url", pushURL)
+		}
+	}
+}
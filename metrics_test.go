@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricsSummary - finished run summary with enrollments synced into two project slugs
+func metricsSummary(status string) *runSummary {
+	s := newRunSummary()
+	s.Status = status
+	s.Finished = time.Unix(1600000000, 0)
+	s.Phases = map[string]summaryPhase{
+		cPhaseSync:              {Counters: map[string]int{"enrollments_added": 3}},
+		projectGroup("finos"):   {Counters: map[string]int{"enrollments_added": 1}},
+		projectGroup("finos-f"): {Counters: map[string]int{"enrollments_added": 2}},
+	}
+	return s
+}
+
+// TestFormatMetrics - enrollments are reported once per project slug only, so summing them gives the total
+func TestFormatMetrics(t *testing.T) {
+	data := string(formatMetrics(runMetrics(metricsSummary(cStatusSuccess))))
+	for _, line := range []string{
+		"# TYPE import_finos_identities_enrollments_added gauge\n",
+		"import_finos_identities_enrollments_added{project_slug=\"finos\"} 1\n",
+		"import_finos_identities_enrollments_added{project_slug=\"finos-f\"} 2\n",
+		"import_finos_identities_success 1\n",
+		"import_finos_identities_last_success_timestamp_seconds 1.6e+09\n",
+	} {
+		if !strings.Contains(data, line) {
+			t.Errorf("missing %q in:\n%s", line, data)
+		}
+	}
+	if strings.Contains(data, "\nimport_finos_identities_enrollments_added ") || strings.Count(data, "# HELP import_finos_identities_enrollments_added ") != 1 {
+		t.Errorf("enrollments_added must only be reported per project slug, described once:\n%s", data)
+	}
+	data = string(formatMetrics(runMetrics(newRunSummary())))
+	if !strings.Contains(data, "import_finos_identities_enrollments_added{project_slug=\"\"} 0\n") {
+		t.Errorf("run without enrollments sync must report empty project slug:\n%s", data)
+	}
+}
+
+// TestWriteMetricsTextfile - failed run keeps last success timestamp written by a previous successful run
+func TestWriteMetricsTextfile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "import.prom")
+	lastSuccess := "import_finos_identities_last_success_timestamp_seconds 1.6e+09"
+	for _, status := range []string{cStatusSuccess, cStatusFailed} {
+		err := writeMetricsTextfile(fn, runMetrics(metricsSummary(status)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), lastSuccess+"\n") || strings.Count(string(data), "# HELP "+cMetricLastSuccess+" ") != 1 {
+			t.Errorf("%s run: expected single %q in:\n%s", status, lastSuccess, string(data))
+		}
+		if status == cStatusFailed && !strings.Contains(string(data), "import_finos_identities_success 0\n") {
+			t.Errorf("failed run must report success 0:\n%s", string(data))
+		}
+	}
+}
+
+// TestPushMetrics - metrics are POSTed to Pushgateway job URL, non 2xx responses are errors
+func TestPushMetrics(t *testing.T) {
+	var (
+		method, path, contentType, body string
+		status                          = http.StatusOK
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, contentType = r.Method, r.URL.Path, r.Header.Get("Content-Type")
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	metrics := runMetrics(metricsSummary(cStatusSuccess))
+	err := pushMetrics(server.URL+"/", "import_finos_identities", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPost || path != "/metrics/job/import_finos_identities" || !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("unexpected push request: %s %s (%s)", method, path, contentType)
+	}
+	if body != string(formatMetrics(metrics)) {
+		t.Errorf("pushed metrics differ from formatted ones:\n%s", body)
+	}
+	status = http.StatusBadRequest
+	err = pushMetrics(server.URL, "import_finos_identities", metrics)
+	if err == nil {
+		t.Fatal("push rejected by server should fail")
+	}
+}
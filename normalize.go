@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// gTransliterations - lower case letters that have no Unicode decomposition to a base letter
+var gTransliterations = map[rune]string{
+	'ß': "ss",
+	'æ': "ae",
+	'œ': "oe",
+	'ø': "o",
+	'đ': "d",
+	'ð': "d",
+	'þ': "th",
+	'ł': "l",
+	'ı': "i",
+	'ħ': "h",
+	'ŧ': "t",
+	'ĸ': "k",
+	'ς': "σ",
+}
+
+// normalizeKey - key used to compare names, usernames and emails, two values are considered the same when their keys are equal:
+// compatibility forms are decomposed (ligatures, full width letters), diacritics are removed from Latin, Greek and Cyrillic letters,
+// letters without decomposition are transliterated (ß is ss, ø is o), case is folded and white space is collapsed.
+// Other scripts (CJK, Arabic, Devanagari, ...) are kept, so names in those scripts never collapse to an empty key.
+// It's used to compare data already read (profiles, merged files, emails, organization names), lookups use lookupKey
+func normalizeKey(s string) string {
+	return foldKey(s, true)
+}
+
+// lookupKey - key used to find people by name, username or email in SortingHat, it only folds what MariaDB
+// utf8mb4_unicode_ci collation folds too (case, diacritics, compatibility forms and trailing spaces), so every storage
+// finds the same people: white space is kept and letters without decomposition are not transliterated
+func lookupKey(s string) string {
+	return foldKey(strings.TrimRight(s, " "), false)
+}
+
+// foldKey - see normalizeKey (full) and lookupKey
+func foldKey(s string, full bool) string {
+	var b strings.Builder
+	stripMarks, space := false, false
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			if !stripMarks {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		if unicode.IsSpace(r) {
+			if !full {
+				b.WriteRune(r)
+				stripMarks = false
+				continue
+			}
+			space = true
+			continue
+		}
+		if unicode.IsControl(r) {
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		stripMarks = unicode.In(r, unicode.Latin, unicode.Greek, unicode.Cyrillic)
+		r = unicode.ToLower(r)
+		if t, ok := gTransliterations[r]; ok && full {
+			b.WriteString(t)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// sameKey - values are the same after normalization (see normalizeKey)
+func sameKey(s1, s2 string) bool {
+	return s1 == s2 || normalizeKey(s1) == normalizeKey(s2)
+}
+
+// sameLookupKey - lookup finds s2 for s1 (see lookupKey)
+func sameLookupKey(s1, s2 string) bool {
+	return s1 == s2 || lookupKey(s1) == lookupKey(s2)
+}
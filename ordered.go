@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var gOrdered bool
+
+// orderedOutput - prints output of items processed concurrently in items order (not in completion order)
+// Used in ordered mode (ORDERED=1), so two runs on the same input produce the same logs
+type orderedOutput struct {
+	mtx     *sync.Mutex
+	next    int
+	pending map[int]*bytes.Buffer
+}
+
+// itemLog - output of a single item, printed immediately when not in ordered mode
+type itemLog struct {
+	out *orderedOutput
+	idx int
+	buf *bytes.Buffer
+}
+
+func newOrderedOutput() *orderedOutput {
+	if !gOrdered {
+		return nil
+	}
+	return &orderedOutput{mtx: &sync.Mutex{}, pending: make(map[int]*bytes.Buffer)}
+}
+
+func (o *orderedOutput) logger(idx int) *itemLog {
+	if o == nil {
+		return &itemLog{}
+	}
+	return &itemLog{out: o, idx: idx, buf: &bytes.Buffer{}}
+}
+
+func (l *itemLog) printf(f string, a ...interface{}) {
+	if l.buf == nil {
+		fmt.Printf(f, a...)
+		return
+	}
+	fmt.Fprintf(l.buf, f, a...)
+}
+
+// done - marks item as finished, prints its output and output of all subsequent finished items
+func (l *itemLog) done() {
+	o := l.out
+	if o == nil {
+		return
+	}
+	o.mtx.Lock()
+	o.pending[l.idx] = l.buf
+	for {
+		buf, ok := o.pending[o.next]
+		if !ok {
+			break
+		}
+		fmt.Print(buf.String())
+		delete(o.pending, o.next)
+		o.next++
+	}
+	o.mtx.Unlock()
+}
+
+// flush - prints output of finished items that still wait for items that were never started (cancelled run)
+func (o *orderedOutput) flush() {
+	if o == nil {
+		return
+	}
+	o.mtx.Lock()
+	idxs := []int{}
+	for idx := range o.pending {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	for _, idx := range idxs {
+		fmt.Print(o.pending[idx].String())
+		delete(o.pending, idx)
+	}
+	o.mtx.Unlock()
+}
+
+func sortedKeys(m map[string]struct{}) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func sortedUUIDs(m map[string]shUIdentity) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func sortedSources(idents map[string][]string) (keys []string) {
+	for key := range idents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// workerPool - runs tasks using at most n goroutines
+// Once context is cancelled no new tasks are started, tasks already running are finished
+type workerPool struct {
+	ctx context.Context
+	sem chan struct{}
+	wg  *sync.WaitGroup
+}
+
+func newWorkerPool(ctx context.Context, n int) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+	return &workerPool{ctx: ctx, sem: make(chan struct{}, n), wg: &sync.WaitGroup{}}
+}
+
+// run - starts task as soon as there is a free worker, with a single worker task is executed synchronously
+// Returns false when task was not started because context was cancelled
+func (p *workerPool) run(task func()) bool {
+	select {
+	case <-p.ctx.Done():
+		return false
+	case p.sem <- struct{}{}:
+	}
+	if p.ctx.Err() != nil {
+		<-p.sem
+		return false
+	}
+	if cap(p.sem) == 1 {
+		task()
+		<-p.sem
+		return true
+	}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		task()
+	}()
+	return true
+}
+
+// wait - waits for all started tasks
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// getPhaseThreadsNum - number of workers for a given phase
+// Lookups and organizations mapping only read from the database: LOOKUP_THREADS
+// Enrollments sync writes to the database: WRITE_THREADS
+// Both default to number of threads (NCPUS), ST=1 forces single thread everywhere
+func getPhaseThreadsNum(env string) int {
+	thrN := getThreadsNum()
+	if os.Getenv("ST") != "" {
+		return thrN
+	}
+	if os.Getenv(env) != "" {
+		n, err := strconv.Atoi(os.Getenv(env))
+		fatalOnError(err)
+		if n > 0 {
+			return n
+		}
+	}
+	return thrN
+}
+
+// handleSignals - first SIGINT/SIGTERM cancels context (graceful shutdown), second one exits immediately
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		gLog.warn("received signal, finishing in-flight work and writing partial reports, send it again to exit immediately", "signal", sig)
+		cancel()
+		sig = <-sigs
+		gLog.warn("received signal again, exiting", "signal", sig)
+		os.Exit(1)
+	}()
+}
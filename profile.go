@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+)
+
+// cISOCountryCodes - ISO 3166-1 alpha-2 country codes (SortingHat countries table)
+const cISOCountryCodes = "AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ " +
+	"CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR " +
+	"GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP " +
+	"KE KG KH KI KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT " +
+	"MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW " +
+	"SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG " +
+	"UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW"
+
+var gISOCountryCodes = make(map[string]struct{})
+
+func init() {
+	for _, code := range strings.Fields(cISOCountryCodes) {
+		gISOCountryCodes[code] = struct{}{}
+	}
+}
+
+// profileField - optional profile field that can be given in identities files, name is both YAML key and profiles column
+type profileField struct {
+	name string
+	get  func(p *shProfile) *string
+	set  func(p *shProfile, value *string)
+}
+
+// gProfileFields - optional string profile fields, is_bot is handled separately
+var gProfileFields = []profileField{
+	{name: "email", get: func(p *shProfile) *string { return p.Email }, set: func(p *shProfile, value *string) { p.Email = value }},
+	{name: "gender", get: func(p *shProfile) *string { return p.Gender }, set: func(p *shProfile, value *string) { p.Gender = value }},
+	{name: "country_code", get: func(p *shProfile) *string { return p.CountryCode }, set: func(p *shProfile, value *string) { p.CountryCode = value }},
+}
+
+func strOrNil(s *string) string {
+	if s == nil {
+		return nils
+	}
+	return *s
+}
+
+func isCountryCode(code string) bool {
+	_, ok := gISOCountryCodes[strings.ToUpper(code)]
+	return ok
+}
+
+// isEmail - only checks the shape (single @, non-empty local part and domain, no spaces)
+func isEmail(email string) bool {
+	ary := strings.Split(email, "@")
+	return len(ary) == 2 && ary[0] != "" && strings.Contains(ary[1], ".") && !strings.ContainsAny(email, " \t")
+}
+
+// normalizeProfile - trims optional fields and upper cases country code like SortingHat stores it, empty values are treated as not given
+func normalizeProfile(p *shProfile) {
+	for _, field := range gProfileFields {
+		value := field.get(p)
+		if value == nil {
+			continue
+		}
+		s := strings.TrimSpace(*value)
+		if field.name == "country_code" {
+			s = strings.ToUpper(s)
+		}
+		if s == "" {
+			field.set(p, nil)
+			continue
+		}
+		field.set(p, &s)
+	}
+}
+
+// profileChanges - returns existing profile with fields given in imported profile that differ from existing ones
+// and names of changed fields; name is never changed (identities are matched by it)
+func profileChanges(imported, existing *shProfile) (updated shProfile, fields []string) {
+	updated = *existing
+	for _, field := range gProfileFields {
+		value := field.get(imported)
+		if value == nil {
+			continue
+		}
+		old := field.get(existing)
+		if old != nil && strings.EqualFold(*old, *value) {
+			continue
+		}
+		field.set(&updated, value)
+		fields = append(fields, field.name)
+	}
+	if imported.IsBot != nil && (existing.IsBot == nil || *existing.IsBot != *imported.IsBot) {
+		updated.IsBot = imported.IsBot
+		fields = append(fields, "is_bot")
+	}
+	return
+}
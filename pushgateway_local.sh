@@ -0,0 +1,9 @@
+#!/bin/bash
+# Starts a local Pushgateway to test metrics push: METRICS_PUSH_URL=http://127.0.0.1:9091
+# Pushed metrics can be checked via: curl -s http://127.0.0.1:9091/metrics | grep import_finos_identities_
+# Stop it via: docker stop import-finos-identities-pushgateway
+if [ -z "${PORT}" ]
+then
+  PORT=9091
+fi
+docker run --rm -d --name import-finos-identities-pushgateway -p "${PORT}:9091" prom/pushgateway
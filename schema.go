@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tableSchema - table columns, indexes (columns in index order) and triggers as reported by the database
+type tableSchema struct {
+	columns  map[string]struct{}
+	indexes  [][]string
+	triggers []tableTrigger
+}
+
+type tableTrigger struct {
+	event     string
+	statement string
+}
+
+// schemaRequirement - table with columns import reads or writes and columns that must lead an index
+type schemaRequirement struct {
+	table   string
+	columns []string
+	indexed []string
+}
+
+// gSchemaRequirements - SortingHat schema import relies on, enrollments origin column is added from ownership policy
+var gSchemaRequirements = []schemaRequirement{
+	{table: "uidentities", columns: []string{"uuid"}, indexed: []string{"uuid"}},
+	{table: "profiles", columns: []string{"uuid", "name", "email", "gender", "gender_acc", "country_code", "is_bot"}, indexed: []string{"uuid"}},
+	{table: "identities", columns: []string{"uuid", "name", "email", "username", "source"}, indexed: []string{"uuid"}},
+	{table: "organizations", columns: []string{"id", "name"}, indexed: []string{"id"}},
+	{table: "enrollments", columns: []string{"id", "uuid", "organization_id", "start", "end", "project_slug"}, indexed: []string{"id", "uuid"}},
+}
+
+func schemaTables() (tables []string) {
+	for _, req := range gSchemaRequirements {
+		tables = append(tables, req.table)
+	}
+	return
+}
+
+// checkSchema - returns problems that make import fail (errors) and ones that only degrade it (warnings)
+// originColumn is the enrollments origin column import writes, empty when origins are not used (OWNERSHIP=all),
+// then origins can only be recorded by enrollments insert trigger using @origin variable
+func checkSchema(schema map[string]*tableSchema, originColumn string) (errs, warns []string) {
+	for _, req := range gSchemaRequirements {
+		table, ok := schema[req.table]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("table %s is missing", req.table))
+			continue
+		}
+		columns := req.columns
+		if req.table == "enrollments" && originColumn != "" {
+			columns = append(append([]string{}, columns...), originColumn)
+		}
+		missing := []string{}
+		for _, column := range columns {
+			if _, ok := table.columns[column]; !ok {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Sprintf("table %s has no %s column(s)", req.table, strings.Join(missing, ", ")))
+		}
+		for _, column := range req.indexed {
+			found := false
+			for _, index := range table.indexes {
+				if len(index) > 0 && index[0] == column {
+					found = true
+					break
+				}
+			}
+			if !found {
+				warns = append(warns, fmt.Sprintf("table %s has no index on %s, lookups will be slow", req.table, column))
+			}
+		}
+		if req.table == "enrollments" && originColumn == "" {
+			found := false
+			for _, trigger := range table.triggers {
+				if strings.EqualFold(trigger.event, "insert") && strings.Contains(strings.ToLower(trigger.statement), "@origin") {
+					found = true
+					break
+				}
+			}
+			if !found {
+				warns = append(warns, "table enrollments has no insert trigger using @origin, origin of added enrollments won't be recorded")
+			}
+		}
+	}
+	return
+}
+
+// schemaPreflight - checks SortingHat schema before import, logs problems and refuses to continue on errors
+// Storages that have no schema to inspect (GraphQL API, in-memory) are not checked, SKIP_SCHEMA_CHECK=1 skips the check
+func schemaPreflight(store shStorage, originColumn string) (ok bool) {
+	if os.Getenv("SKIP_SCHEMA_CHECK") != "" {
+		gLog.warn("schema check skipped")
+		return true
+	}
+	schema, err := store.schema(schemaTables())
+	fatalOnError(err)
+	if schema == nil {
+		gLog.debug("storage has no schema to check")
+		return true
+	}
+	errs, warns := checkSchema(schema, originColumn)
+	for _, warn := range warns {
+		gLog.warn("schema check", "problem", warn)
+	}
+	for _, e := range errs {
+		gLog.error("schema check", "problem", e)
+	}
+	if len(errs) > 0 {
+		return false
+	}
+	gLog.info("schema check passed", "warnings", len(warns))
+	return true
+}
+
+// importOriginColumn - enrollments origin column import uses with current ownership settings
+func importOriginColumn() string {
+	policy := newOwnershipPolicy()
+	if policy.mode == cOwnershipAll {
+		return ""
+	}
+	return policy.column
+}
+
+func runCheckSchema(args []string) int {
+	store, closeStorage := connectStorage()
+	defer closeStorage()
+	if !schemaPreflight(store, importOriginColumn()) {
+		return 1
+	}
+	return 0
+}
+
+// schemaBuilder - collects tables schema from database metadata rows
+type schemaBuilder struct {
+	tables  map[string]*tableSchema
+	indexes map[string]int
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{tables: make(map[string]*tableSchema), indexes: make(map[string]int)}
+}
+
+func (b *schemaBuilder) table(name string) *tableSchema {
+	t, ok := b.tables[name]
+	if !ok {
+		t = &tableSchema{columns: make(map[string]struct{})}
+		b.tables[name] = t
+	}
+	return t
+}
+
+func (b *schemaBuilder) column(table, column string) {
+	b.table(table).columns[strings.ToLower(column)] = struct{}{}
+}
+
+// index - adds index column at a given position, seq starts at 1 (like information_schema.statistics.seq_in_index)
+func (b *schemaBuilder) index(table, index string, seq int, column string) {
+	t := b.table(table)
+	key := table + "." + index
+	i, ok := b.indexes[key]
+	if !ok {
+		t.indexes = append(t.indexes, []string{})
+		i = len(t.indexes) - 1
+		b.indexes[key] = i
+	}
+	for len(t.indexes[i]) < seq {
+		t.indexes[i] = append(t.indexes[i], "")
+	}
+	t.indexes[i][seq-1] = strings.ToLower(column)
+}
+
+func (b *schemaBuilder) trigger(table, event, statement string) {
+	t := b.table(table)
+	t.triggers = append(t.triggers, tableTrigger{event: event, statement: statement})
+}
+
+// finish - returns tables that exist (have columns)
+func (b *schemaBuilder) finish() map[string]*tableSchema {
+	schema := make(map[string]*tableSchema)
+	for name, t := range b.tables {
+		if len(t.columns) > 0 {
+			schema[name] = t
+		}
+	}
+	return schema
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// cSQLiteDriver - driver is only linked in when built with sqlite tag (see sqlite_driver.go), it needs CGO
+// it is go-sqlite3 with cSQLiteKeyFunc function registered on every connection
+const cSQLiteDriver = "sqlite3_import"
+
+// cSQLiteKeyFunc - SQL function returning lookupKey of its argument, used by names, emails and usernames lookups
+const cSQLiteKeyFunc = "lookup_key"
+
+// cSQLiteSchema - SortingHat tables used by the import (and the ones they reference), SQLite flavour
+// Enrollments origin column is "origin" (ENROLLMENTS_ORIGIN_COLUMN default), names, emails and usernames use nocase collation
+// so lookups shared with MariaDB storage are case insensitive like with MariaDB utf8mb4_unicode_ci collation
+var cSQLiteSchema = []string{
+	"create table if not exists organizations(" +
+		"id integer primary key autoincrement, " +
+		"name varchar(191) not null unique collate nocase)",
+	"create table if not exists domains_organizations(" +
+		"id integer primary key autoincrement, " +
+		"domain varchar(128) not null unique, " +
+		"is_top_domain tinyint(1), " +
+		"organization_id int not null references organizations(id) on delete cascade)",
+	"create table if not exists countries(" +
+		"code varchar(2) not null primary key, " +
+		"name varchar(191) not null, " +
+		"alpha3 varchar(3) not null)",
+	"create table if not exists uidentities(" +
+		"uuid varchar(128) not null primary key, " +
+		"last_modified datetime)",
+	"create table if not exists profiles(" +
+		"uuid varchar(128) not null primary key references uidentities(uuid) on delete cascade, " +
+		"name varchar(191) collate nocase, " +
+		"email varchar(191), " +
+		"gender varchar(32), " +
+		"gender_acc int, " +
+		"is_bot tinyint(1), " +
+		"country_code varchar(2) references countries(code))",
+	"create table if not exists identities(" +
+		"id varchar(128) not null primary key, " +
+		"name varchar(191) collate nocase, " +
+		"email varchar(191) collate nocase, " +
+		"username varchar(191) collate nocase, " +
+		"source varchar(32) not null, " +
+		"uuid varchar(128) references uidentities(uuid) on delete cascade, " +
+		"last_modified datetime)",
+	"create index if not exists identities_uuid_idx on identities(uuid)",
+	"create table if not exists enrollments(" +
+		"id integer primary key autoincrement, " +
+		"start datetime not null, " +
+		"end datetime not null, " +
+		"uuid varchar(128) not null references uidentities(uuid) on delete cascade, " +
+		"organization_id int not null references organizations(id) on delete cascade, " +
+		"project_slug varchar(128), " +
+		"origin varchar(128))",
+	"create index if not exists enrollments_uuid_idx on enrollments(uuid)",
+	"create table if not exists " + cAuditTable + "(" +
+		"id integer primary key autoincrement, " +
+		"run_id varchar(64) not null, " +
+		"dt_created datetime not null, " +
+		"uuid varchar(128) not null, " +
+		"action varchar(32) not null, " +
+		"old_value text, " +
+		"new_value text, " +
+		"source_file varchar(512), " +
+		"source_line int, " +
+		"source_record text)",
+	"create index if not exists " + cAuditTable + "_uuid_idx on " + cAuditTable + "(uuid)",
+	"create index if not exists " + cAuditTable + "_run_id_idx on " + cAuditTable + "(run_id)",
+}
+
+// sqliteStorage - SortingHat schema in a SQLite file (SH_SQLITE), for local runs and CI on small fixtures
+// Most queries are shared with mysqlStorage, only MySQL specific constructs are overridden
+type sqliteStorage struct {
+	*mysqlStorage
+}
+
+func newSQLiteStorage(db *sql.DB) *sqliteStorage {
+	s := &sqliteStorage{mysqlStorage: newMySQLStorage(db)}
+	// nocase collation only folds ASCII letters, lookups compare lookup keys instead
+	s.keyFunc = cSQLiteKeyFunc
+	return s
+}
+
+// openSQLite - opens SQLite database file, there is a single connection because SQLite serializes writers anyway
+func openSQLite(path string) *sql.DB {
+	found := false
+	for _, driver := range sql.Drivers() {
+		if driver == cSQLiteDriver {
+			found = true
+			break
+		}
+	}
+	if !found {
+		fatalf("SQLite support is not compiled in, build with: make import-identities-sqlite")
+	}
+	db, err := sql.Open(cSQLiteDriver, "file:"+path+"?_busy_timeout=5000&_foreign_keys=1")
+	fatalOnError(err)
+	configureDB(db)
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	// in-memory database is gone when its only connection is closed
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+	pingDB(db)
+	return db
+}
+
+// createSQLiteSchema - creates SortingHat tables that don't exist yet
+func createSQLiteSchema(db *sql.DB) error {
+	for _, stmt := range cSQLiteSchema {
+		_, err := exec(db, "", stmt)
+		if err != nil {
+			return err
+		}
+	}
+	// profiles.country_code references countries, import doesn't use country names (code is used as a name)
+	for _, code := range strings.Fields(cISOCountryCodes) {
+		_, err := exec(db, "", "insert or ignore into countries(code, name, alpha3) values(?, ?, '')", code, code)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOrigin - SQLite has no session variables (and no triggers using them), origin is written by addEnrollment
+func (s *sqliteStorage) setOrigin(origin string) error {
+	return nil
+}
+
+// matchesRegexp - SQLite has no regexp function, Go regexp matched case insensitively (like MariaDB's default collation)
+func (s *sqliteStorage) matchesRegexp(str, re string) (bool, error) {
+	return matchesRegexpCI(str, re)
+}
+
+func (s *sqliteStorage) ensureAuditTable() error {
+	for _, stmt := range cSQLiteSchema {
+		if strings.Contains(stmt, " "+cAuditTable) {
+			_, err := exec(s.db, "", stmt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schema - reads tables metadata via pragmas, there are no triggers (origin is only written when import uses origins)
+func (s *sqliteStorage) schema(tables []string) (map[string]*tableSchema, error) {
+	b := newSchemaBuilder()
+	for _, table := range tables {
+		rows, err := query(s.db, "select name, pk from pragma_table_info(?)", table)
+		if err != nil {
+			return nil, err
+		}
+		err = scanRows(rows, func() error {
+			var (
+				column string
+				pk     int
+			)
+			e := rows.Scan(&column, &pk)
+			b.column(table, column)
+			// integer primary key is the rowid, it has no index in index_list
+			if pk > 0 {
+				b.index(table, "primary", pk, column)
+			}
+			return e
+		})
+		if err != nil {
+			return nil, err
+		}
+		rows, err = query(s.db, "select il.name, ii.seqno, ii.name from pragma_index_list(?) il, pragma_index_info(il.name) ii", table)
+		if err != nil {
+			return nil, err
+		}
+		err = scanRows(rows, func() error {
+			var (
+				index, column string
+				seq           int
+			)
+			e := rows.Scan(&index, &seq, &column)
+			b.index(table, index, seq+1, column)
+			return e
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.finish(), nil
+}
+
+func runCreateSchema(args []string) int {
+	path := os.Getenv("SH_SQLITE")
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "SH_SQLITE is required: SH_SQLITE=sortinghat.db create-schema\n")
+		return 2
+	}
+	db := openSQLite(path)
+	defer func() { fatalOnError(db.Close()) }()
+	fatalOnError(createSQLiteSchema(db))
+	gLog.info("schema created", "sqlite", path)
+	return 0
+}
@@ -0,0 +1,30 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// SQLite driver needs CGO, so it is only linked in when building with: make import-identities-sqlite
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register(cSQLiteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc(cSQLiteKeyFunc, sqliteLookupKey, true)
+		},
+	})
+}
+
+// sqliteLookupKey - lookupKey as SQL function, NULL (passed as nil []byte) is an empty key
+func sqliteLookupKey(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return lookupKey(v)
+	case []byte:
+		return lookupKey(string(v))
+	}
+	return ""
+}
@@ -0,0 +1,204 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// cSQLiteTestSeed - John Doe (u1) with enrollments from import and from another tool (in another project slug),
+// J. Smith (u2) with GitHub username jsmith, José Müller (u3) and Иван Петров (u4) without enrollments,
+// Mary Major (u5) with enrollments from import and from another tool in the same project slug
+var cSQLiteTestSeed = []string{
+	"insert into organizations(id, name) values(1, 'Company A'), (2, 'Company B'), (3, 'Company C')",
+	"insert into uidentities(uuid) values('u1'), ('u2'), ('u3'), ('u4'), ('u5')",
+	"insert into profiles(uuid, name) values('u1', 'John Doe'), ('u2', 'J. Smith'), ('u3', 'José Müller'), ('u4', 'Иван Петров'), ('u5', 'Mary Major')",
+	"insert into identities(id, name, username, source, uuid) values('i2', 'J. Smith', 'jsmith', 'github', 'u2')",
+	"insert into enrollments(start, end, uuid, organization_id, project_slug, origin) values" +
+		"('1900-01-01 00:00:00', '2100-01-01 00:00:00', 'u1', 2, null, 'import-finos-identities'), " +
+		"('1900-01-01 00:00:00', '2100-01-01 00:00:00', 'u1', 3, 'finos-other', 'affiliations-api'), " +
+		"('1900-01-01 00:00:00', '2100-01-01 00:00:00', 'u5', 1, null, 'import-finos-identities'), " +
+		"('1900-01-01 00:00:00', '2100-01-01 00:00:00', 'u5', 2, null, 'affiliations-api')",
+}
+
+// sqliteEnrollments - sorted "organization/project slug/origin" of all enrollments of a given uuid
+func sqliteEnrollments(db *sql.DB, uuid string) (rols []string, err error) {
+	rows, err := db.Query("select o.name, coalesce(e.project_slug, '(nil)'), coalesce(e.origin, 'null') from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var org, slug, origin string
+		err = rows.Scan(&org, &slug, &origin)
+		if err != nil {
+			return
+		}
+		rols = append(rols, org+"/"+slug+"/"+origin)
+	}
+	sort.Strings(rols)
+	err = rows.Err()
+	return
+}
+
+// TestSQLiteImport - import into SQLite SortingHat schema, queries are shared with MariaDB storage
+func TestSQLiteImport(t *testing.T) {
+	cases := []struct {
+		name  string
+		env   map[string]string
+		input string
+		uuid  string
+		rols  []string
+	}{
+		{
+			name: "match by name, without replace existing enrollments are kept",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn},
+			input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+			uuid: "u1",
+			rols: []string{"Company B/(nil)/import-finos-identities", "Company C/finos-other/affiliations-api"},
+		},
+		{
+			name: "replace own enrollments, keep other origins in other project slugs",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn, "COMPARE": "1", "REPLACE": "1"},
+			input: `
+- profile:
+    name: John Doe
+  enrollments:
+  - organization: Company A
+`,
+			uuid: "u1",
+			rols: []string{"Company A/(nil)/import-finos-identities", "Company C/finos-other/affiliations-api"},
+		},
+		{
+			name: "match by source and username, origin is written",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn, "PROJECT_SLUG": "finos-f"},
+			input: `
+- profile:
+    name: Joe Smith
+  github:
+  - jsmith
+  enrollments:
+  - organization: company b
+`,
+			uuid: "u2",
+			rols: []string{"Company B/finos-f/import-finos-identities"},
+		},
+		{
+			name: "name lookup is case insensitive",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn, "COMPARE": "1", "REPLACE": "1"},
+			input: `
+- profile:
+    name: john doe
+  enrollments:
+  - organization: Company A
+`,
+			uuid: "u1",
+			rols: []string{"Company A/(nil)/import-finos-identities", "Company C/finos-other/affiliations-api"},
+		},
+		{
+			name: "username lookup is case insensitive",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn},
+			input: `
+- profile:
+    name: Joe Smith
+  github:
+  - JSmith
+  enrollments:
+  - organization: Company C
+`,
+			uuid: "u2",
+			rols: []string{"Company C/(nil)/import-finos-identities"},
+		},
+		{
+			name: "name lookup ignores diacritics",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn},
+			input: `
+- profile:
+    name: jose muller
+  enrollments:
+  - organization: Company A
+`,
+			uuid: "u3",
+			rols: []string{"Company A/(nil)/import-finos-identities"},
+		},
+		{
+			name: "name lookup folds non-ASCII case",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn},
+			input: `
+- profile:
+    name: ИВАН ПЕТРОВ
+  enrollments:
+  - organization: Company B
+`,
+			uuid: "u4",
+			rols: []string{"Company B/(nil)/import-finos-identities"},
+		},
+		{
+			name: "other origin takes precedence, own enrollments are deleted",
+			env:  map[string]string{"OWNERSHIP": cOwnershipOwn, "COMPARE": "1", "REPLACE": "1"},
+			input: `
+- profile:
+    name: Mary Major
+  enrollments:
+  - organization: Company C
+`,
+			uuid: "u5",
+			rols: []string{"Company B/(nil)/affiliations-api"},
+		},
+		{
+			name: "missing profile is not added",
+			input: `
+- profile:
+    name: Nobody
+  enrollments:
+  - organization: Company A
+`,
+			uuid: "u2",
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			db := openSQLite(":memory:")
+			defer func() { _ = db.Close() }()
+			err := createSQLiteSchema(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stmt := range cSQLiteTestSeed {
+				_, err = db.Exec(stmt)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			dir := t.TempDir()
+			fn := filepath.Join(dir, "identities.yaml")
+			err = ioutil.WriteFile(fn, []byte(strings.TrimLeft(tc.input, "\n")), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = importIsolated(dir, tc.env, newSQLiteStorage(db), []string{fn})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rols, err := sqliteEnrollments(db, tc.uuid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(rols, ",") != strings.Join(tc.rols, ",") {
+				t.Errorf("%s enrollments: expected %v, got %v", tc.uuid, tc.rols, rols)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// import phases, in order of execution
+const (
+	cPhaseParse      = "parse"
+	cPhaseCleanup    = "cleanup"
+	cPhaseLookup     = "lookup"
+	cPhaseMerge      = "merge"
+	cPhaseOrgMapping = "org_mapping"
+	cPhaseSync       = "enrollment_sync"
+)
+
+var gStats = newRunStats()
+
+// runStats - counters and durations of all import phases, safe for concurrent use
+// Counters are grouped, each phase has its own group, enrollments sync has an additional group per project slug
+type runStats struct {
+	mtx       *sync.Mutex
+	started   time.Time
+	groups    []string
+	durations map[string]time.Duration
+	counters  map[string]map[string]int
+}
+
+func newRunStats() *runStats {
+	return &runStats{
+		mtx:       &sync.Mutex{},
+		started:   time.Now(),
+		durations: make(map[string]time.Duration),
+		counters:  make(map[string]map[string]int),
+	}
+}
+
+// must be called with mtx locked
+func (s *runStats) group(name string) map[string]int {
+	counters, ok := s.counters[name]
+	if !ok {
+		counters = make(map[string]int)
+		s.counters[name] = counters
+		s.groups = append(s.groups, name)
+	}
+	return counters
+}
+
+// phase - starts measuring a given phase, returned function stops it
+// The same phase can be measured multiple times (once per input file), durations are summed
+func (s *runStats) phase(name string) func() {
+	s.mtx.Lock()
+	s.group(name)
+	s.mtx.Unlock()
+	dtStart := time.Now()
+	return func() {
+		s.mtx.Lock()
+		s.durations[name] += time.Since(dtStart)
+		s.mtx.Unlock()
+	}
+}
+
+func (s *runStats) add(group, counter string, n int) {
+	s.mtx.Lock()
+	s.group(group)[counter] += n
+	s.mtx.Unlock()
+}
+
+func (s *runStats) inc(group, counter string) {
+	s.add(group, counter, 1)
+}
+
+func (s *runStats) get(group, counter string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.counters[group][counter]
+}
+
+// projectGroup - enrollments sync counters for a given project slug
+func projectGroup(slug string) string {
+	return cPhaseSync + ":" + slug
+}
+
+// print - logs summary of all phases, one line per phase with its duration and counters
+func (s *runStats) print() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, group := range s.groups {
+		kv := []interface{}{"phase", group}
+		duration, ok := s.durations[group]
+		if ok {
+			kv = append(kv, "duration", duration)
+		}
+		counters := s.counters[group]
+		names := []string{}
+		for name := range counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			kv = append(kv, name, counters[name])
+		}
+		gLog.info("summary", kv...)
+	}
+	gLog.info("summary", "phase", "total", "duration", time.Since(s.started))
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// identityQuery - identities lookup conditions, nil means condition is not used
+type identityQuery struct {
+	name     *string
+	email    *string
+	source   *string
+	username *string
+}
+
+// shStorage - SortingHat operations used by the import
+// mysqlStorage talks to SortingHat MariaDB database, memoryStorage keeps everything in memory (used by tests)
+type shStorage interface {
+	// setOrigin - sets (or checks) origin of changes recorded by database triggers
+	setOrigin(origin string) error
+	// profileUUIDs - distinct uuids of profiles with a given name, at most two (enough to detect ambiguity)
+	profileUUIDs(name string) ([]string, error)
+	// identityUUIDs - distinct uuids of identities matching all given conditions, at most two
+	identityUUIDs(q identityQuery) ([]string, error)
+	// organizations - all organizations, id -> name
+	organizations() (map[int]string, error)
+	// matchesRegexp - checks if s matches organization mapping regular expression (case insensitive)
+	matchesRegexp(s, re string) (bool, error)
+	uidentityExists(uuid string) (bool, error)
+	// profile - returns nil when there is no profile for a given uuid
+	profile(uuid string) (*shProfile, error)
+	// updateProfile - writes given fields of a profile (gProfileFields names and is_bot)
+	updateProfile(profile *shProfile, fields []string) error
+	// identityEmail - email of uuid's identity with a given source and username, email is not null
+	identityEmail(uuid, source, username string) (string, bool, error)
+	// enrollments - enrollments of uuid in a given project slug, originColumn can be empty (origins are not fetched)
+	enrollments(uuid string, projectSlug *string, originColumn string) ([]shEnrollment, error)
+	deleteEnrollments(uuid string, projectSlug *string) error
+	deleteEnrollment(id int) error
+	// addEnrollment - adds enrollment into a given project slug, origin is only written when originColumn is not empty
+	addEnrollment(enrollment *shEnrollment, projectSlug *string, originColumn, origin string) error
+	ensureAuditTable() error
+	addAuditEntry(entry *auditEntry) error
+	auditEntries(uuid string) ([]auditEntry, error)
+	// schema - columns, indexes and triggers of given tables (missing tables are not returned), nil when storage has no schema
+	schema(tables []string) (map[string]*tableSchema, error)
+	// hasProjectSlugs - false when storage cannot keep enrollments project slugs (import fails before any change then)
+	hasProjectSlugs() bool
+}
+
+// firstKeys - sorted keys, at most max of them
+func firstKeys(m map[string]struct{}, max int) []string {
+	keys := sortedKeys(m)
+	if len(keys) > max {
+		keys = keys[:max]
+	}
+	return keys
+}
+
+// matchesRegexpCI - organization mapping regexp matched case insensitively, for storages without MariaDB regexp
+func matchesRegexpCI(str, re string) (bool, error) {
+	r, err := regexp.Compile("(?i)" + re)
+	if err != nil {
+		return false, err
+	}
+	return r.MatchString(str), nil
+}
+
+// mysqlStorage - SortingHat MariaDB database
+type mysqlStorage struct {
+	db *sql.DB
+	// keyFunc - SQL function returning lookupKey of a column (SQLite), empty when column collation is used (MariaDB)
+	keyFunc string
+}
+
+func newMySQLStorage(db *sql.DB) *mysqlStorage {
+	return &mysqlStorage{db: db}
+}
+
+// queryStrings - runs query returning single string column, stops after max rows
+func (s *mysqlStorage) queryStrings(max int, queryStr string, args ...interface{}) (values []string, err error) {
+	rows, err := query(s.db, queryStr, args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		values = append(values, value)
+		if max > 0 && len(values) >= max {
+			break
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// setOrigin - @origin is set on every connection when it's opened (see openMySQL), this checks it has a given value
+func (s *mysqlStorage) setOrigin(origin string) error {
+	var current sql.NullString
+	err := s.db.QueryRow("select @origin").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current.String != origin {
+		return fmt.Errorf("connection @origin is '%s', expected '%s'", current.String, origin)
+	}
+	return nil
+}
+
+// keyCond - lookup condition on a name, email or username column, with keyFunc set lookup keys are compared,
+// otherwise column collation selects candidates (MariaDB utf8mb4_unicode_ci folds at least what lookupKey does),
+// they are checked by lookupUUIDs
+func (s *mysqlStorage) keyCond(column, value string) (string, interface{}) {
+	if s.keyFunc == "" {
+		return column + " = ?", value
+	}
+	return column + " is not null and " + s.keyFunc + "(" + column + ") = ?", lookupKey(value)
+}
+
+// lookupUUIDs - runs query returning uuid and compared columns, uses rows whose columns are found for values (see sameLookupKey),
+// so SQL lookups match exactly like memory and GraphQL storages do, stops after two distinct uuids
+func (s *mysqlStorage) lookupUUIDs(queryStr string, values []string, args ...interface{}) (uuids []string, err error) {
+	rows, err := query(s.db, queryStr, args...)
+	if err != nil {
+		return
+	}
+	found := make(map[string]struct{})
+	columns := make([]sql.NullString, len(values))
+	dest := []interface{}{new(string)}
+	for i := range columns {
+		dest = append(dest, &columns[i])
+	}
+	for rows.Next() {
+		err = rows.Scan(dest...)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		same := true
+		for i, value := range values {
+			if !columns[i].Valid || !sameLookupKey(columns[i].String, value) {
+				same = false
+				break
+			}
+		}
+		uuid := *dest[0].(*string)
+		if _, ok := found[uuid]; !same || ok {
+			continue
+		}
+		found[uuid] = struct{}{}
+		uuids = append(uuids, uuid)
+		if len(uuids) >= 2 {
+			break
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+func (s *mysqlStorage) profileUUIDs(name string) ([]string, error) {
+	cond, arg := s.keyCond("name", name)
+	return s.lookupUUIDs("select distinct uuid, name from profiles where "+cond, []string{name}, arg)
+}
+
+func (s *mysqlStorage) identityUUIDs(q identityQuery) ([]string, error) {
+	conds, columns, values := []string{}, []string{"uuid"}, []string{}
+	args := []interface{}{}
+	if q.source != nil {
+		conds = append(conds, "source = ?")
+		args = append(args, *q.source)
+	}
+	for _, key := range []struct {
+		column string
+		value  *string
+	}{{"name", q.name}, {"username", q.username}, {"email", q.email}} {
+		if key.value == nil {
+			continue
+		}
+		cond, arg := s.keyCond(key.column, *key.value)
+		conds = append(conds, cond)
+		args = append(args, arg)
+		columns = append(columns, key.column)
+		values = append(values, *key.value)
+	}
+	return s.lookupUUIDs("select distinct "+strings.Join(columns, ", ")+" from identities where "+strings.Join(conds, " and "), values, args...)
+}
+
+func (s *mysqlStorage) organizations() (orgs map[int]string, err error) {
+	rows, err := query(s.db, "select id, name from organizations")
+	if err != nil {
+		return
+	}
+	orgs = make(map[int]string)
+	for rows.Next() {
+		var (
+			id   int
+			name string
+		)
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		orgs[id] = name
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+func (s *mysqlStorage) matchesRegexp(str, re string) (bool, error) {
+	values, err := s.queryStrings(1, "select ? regexp ?", str, re)
+	if err != nil || len(values) == 0 {
+		return false, err
+	}
+	return values[0] != "0", nil
+}
+
+func (s *mysqlStorage) uidentityExists(uuid string) (bool, error) {
+	values, err := s.queryStrings(1, "select uuid from uidentities where uuid = ?", uuid)
+	return len(values) > 0, err
+}
+
+func (s *mysqlStorage) profile(uuid string) (profile *shProfile, err error) {
+	rows, err := query(s.db, "select uuid, coalesce(name, ''), email, gender, country_code, is_bot from profiles where uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		profile = &shProfile{}
+		err = rows.Scan(&profile.UUID, &profile.Name, &profile.Email, &profile.Gender, &profile.CountryCode, &profile.IsBot)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		break
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// updateProfile - gender accuracy is set to 100 together with gender (gender given by a person, not guessed)
+func (s *mysqlStorage) updateProfile(profile *shProfile, fields []string) (err error) {
+	sets := []string{}
+	args := []interface{}{}
+	for _, name := range fields {
+		if name == "is_bot" {
+			sets = append(sets, "is_bot = ?")
+			args = append(args, profile.IsBot)
+			continue
+		}
+		for _, field := range gProfileFields {
+			if field.name == name {
+				sets = append(sets, name+" = ?")
+				args = append(args, field.get(profile))
+			}
+		}
+		if name == "gender" {
+			sets = append(sets, "gender_acc = ?")
+			args = append(args, 100)
+		}
+	}
+	if len(sets) == 0 {
+		return
+	}
+	args = append(args, profile.UUID)
+	_, err = exec(s.db, "", "update profiles set "+strings.Join(sets, ", ")+" where uuid = ?", args...)
+	return
+}
+
+func (s *mysqlStorage) identityEmail(uuid, source, username string) (string, bool, error) {
+	cond, arg := s.keyCond("username", username)
+	values, err := s.queryStrings(
+		1,
+		"select coalesce(email, '') from identities where uuid = ? and source = ? and "+cond+" and email is not null",
+		uuid,
+		source,
+		arg,
+	)
+	if err != nil || len(values) == 0 {
+		return "", false, err
+	}
+	return values[0], true, nil
+}
+
+func (s *mysqlStorage) enrollments(uuid string, projectSlug *string, originColumn string) (enrollments []shEnrollment, err error) {
+	queryStr := "select id, uuid, organization_id, start, end, project_slug"
+	if originColumn != "" {
+		queryStr += ", " + originColumn
+	}
+	var rows *sql.Rows
+	if projectSlug == nil {
+		queryStr += " from enrollments where uuid = ? and project_slug is null"
+		rows, err = query(s.db, queryStr, uuid)
+	} else {
+		queryStr += " from enrollments where uuid = ? and project_slug = ?"
+		rows, err = query(s.db, queryStr, uuid, *projectSlug)
+	}
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var enrollment shEnrollment
+		dest := []interface{}{
+			&enrollment.ID,
+			&enrollment.UUID,
+			&enrollment.OrgID,
+			&enrollment.Start,
+			&enrollment.End,
+			&enrollment.ProjectSlug,
+		}
+		if originColumn != "" {
+			dest = append(dest, &enrollment.Origin)
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		enrollments = append(enrollments, enrollment)
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+func (s *mysqlStorage) deleteEnrollments(uuid string, projectSlug *string) (err error) {
+	if projectSlug == nil {
+		_, err = exec(s.db, "", "delete from enrollments where uuid = ? and project_slug is null", uuid)
+		return
+	}
+	_, err = exec(s.db, "", "delete from enrollments where uuid = ? and project_slug = ?", uuid, *projectSlug)
+	return
+}
+
+func (s *mysqlStorage) deleteEnrollment(id int) error {
+	_, err := exec(s.db, "", "delete from enrollments where id = ?", id)
+	return err
+}
+
+func (s *mysqlStorage) addEnrollment(enrollment *shEnrollment, projectSlug *string, originColumn, origin string) (err error) {
+	if originColumn != "" {
+		_, err = exec(
+			s.db,
+			"",
+			"insert into enrollments(uuid, organization_id, start, end, project_slug, "+originColumn+") values(?,?,?,?,?,?)",
+			enrollment.UUID,
+			enrollment.OrgID,
+			enrollment.Start,
+			enrollment.End,
+			projectSlug,
+			origin,
+		)
+		return
+	}
+	_, err = exec(
+		s.db,
+		"",
+		"insert into enrollments(uuid, organization_id, start, end, project_slug) values(?,?,?,?,?)",
+		enrollment.UUID,
+		enrollment.OrgID,
+		enrollment.Start,
+		enrollment.End,
+		projectSlug,
+	)
+	return
+}
+
+func (s *mysqlStorage) ensureAuditTable() error {
+	_, err := exec(
+		s.db,
+		"",
+		"create table if not exists "+cAuditTable+"("+
+			"id int not null auto_increment primary key, "+
+			"run_id varchar(64) not null, "+
+			"dt_created datetime(6) not null, "+
+			"uuid varchar(128) not null, "+
+			"action varchar(32) not null, "+
+			"old_value text, "+
+			"new_value text, "+
+			"source_file varchar(512), "+
+			"source_line int, "+
+			"source_record text, "+
+			"key "+cAuditTable+"_uuid_idx(uuid), "+
+			"key "+cAuditTable+"_run_id_idx(run_id)"+
+			") engine=InnoDB default charset=utf8mb4",
+	)
+	if err != nil {
+		return err
+	}
+	// audit tables created before source line was tracked
+	values, err := s.queryStrings(
+		1,
+		"select count(*) from information_schema.columns where table_schema = database() and table_name = ? and column_name = 'source_line'",
+		cAuditTable,
+	)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 || values[0] == "0" {
+		_, err = exec(s.db, "", "alter table "+cAuditTable+" add source_line int after source_file")
+	}
+	return err
+}
+
+func (s *mysqlStorage) addAuditEntry(entry *auditEntry) error {
+	_, err := exec(
+		s.db,
+		"",
+		"insert into "+cAuditTable+"(run_id, dt_created, uuid, action, old_value, new_value, source_file, source_line, source_record) values(?,?,?,?,?,?,?,?,?)",
+		entry.RunID,
+		entry.DtCreated,
+		entry.UUID,
+		entry.Action,
+		entry.OldValue,
+		entry.NewValue,
+		entry.SourceFile,
+		entry.SourceLine,
+		entry.SourceRecord,
+	)
+	return err
+}
+
+func (s *mysqlStorage) auditEntries(uuid string) (entries []auditEntry, err error) {
+	rows, err := query(
+		s.db,
+		"select id, run_id, dt_created, uuid, action, old_value, new_value, source_file, source_line, source_record from "+cAuditTable+" where uuid = ? order by dt_created, id",
+		uuid,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var entry auditEntry
+		err = rows.Scan(
+			&entry.ID,
+			&entry.RunID,
+			&entry.DtCreated,
+			&entry.UUID,
+			&entry.Action,
+			&entry.OldValue,
+			&entry.NewValue,
+			&entry.SourceFile,
+			&entry.SourceLine,
+			&entry.SourceRecord,
+		)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+func (s *mysqlStorage) hasProjectSlugs() bool {
+	return true
+}
+
+// schema - reads tables metadata from information_schema of the current database
+func (s *mysqlStorage) schema(tables []string) (map[string]*tableSchema, error) {
+	b := newSchemaBuilder()
+	in := strings.TrimSuffix(strings.Repeat("?,", len(tables)), ",")
+	args := []interface{}{}
+	for _, table := range tables {
+		args = append(args, table)
+	}
+	rows, err := query(s.db, "select table_name, column_name from information_schema.columns where table_schema = database() and table_name in ("+in+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	err = scanRows(rows, func() error {
+		var table, column string
+		e := rows.Scan(&table, &column)
+		b.column(table, column)
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	rows, err = query(
+		s.db,
+		"select table_name, index_name, seq_in_index, column_name from information_schema.statistics where table_schema = database() and table_name in ("+in+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = scanRows(rows, func() error {
+		var (
+			table, index, column string
+			seq                  int
+		)
+		e := rows.Scan(&table, &index, &seq, &column)
+		b.index(table, index, seq, column)
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	rows, err = query(
+		s.db,
+		"select event_object_table, event_manipulation, action_statement from information_schema.triggers where trigger_schema = database() and event_object_table in ("+in+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = scanRows(rows, func() error {
+		var table, event, statement string
+		e := rows.Scan(&table, &event, &statement)
+		b.trigger(table, event, statement)
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.finish(), nil
+}
+
+// scanRows - calls scan for every row and closes rows
+func scanRows(rows *sql.Rows, scan func() error) (err error) {
+	for rows.Next() {
+		err = scan()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	return rows.Close()
+}
+
+// newAuditEntry - audit record of a change made to a given identity in the current run
+func newAuditEntry(uidentity *shUIdentity, action string, oldValue, newValue *string) *auditEntry {
+	entry := &auditEntry{
+		RunID:     gRunID,
+		DtCreated: time.Now(),
+		UUID:      uidentity.UUID,
+		Action:    action,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+	}
+	if uidentity.SourceFile != "" {
+		sourceFile, sourceLine := uidentity.SourceFile, uidentity.SourceLine
+		entry.SourceFile = &sourceFile
+		entry.SourceLine = &sourceLine
+	}
+	if uidentity.SourceRecord != "" {
+		sourceRecord := uidentity.SourceRecord
+		entry.SourceRecord = &sourceRecord
+	}
+	return entry
+}
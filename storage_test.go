@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeQueryConn - records queries and their arguments, returns given rows (like MariaDB collation selected them)
+type fakeQueryConn struct {
+	queries *[]string
+	rows    [][]driver.Value
+}
+
+func (c *fakeQueryConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fakeQueryConn) Close() error {
+	return nil
+}
+
+func (c *fakeQueryConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fakeQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := []string{}
+	for _, arg := range args {
+		values = append(values, fmt.Sprintf("%v", arg.Value))
+	}
+	*c.queries = append(*c.queries, query+" "+strings.Join(values, ","))
+	return &fakeRows{rows: c.rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"uuid"}
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type fakeQueryConnector struct {
+	queries []string
+	rows    [][]driver.Value
+}
+
+func (c *fakeQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeQueryConn{queries: &c.queries, rows: c.rows}, nil
+}
+
+func (c *fakeQueryConnector) Driver() driver.Driver {
+	return nil
+}
+
+// TestMySQLLookups - MariaDB lookups pass values as they are (collation selects candidates),
+// candidates are only used when lookup finds them in memory and SQLite too (see lookupKey)
+func TestMySQLLookups(t *testing.T) {
+	cases := []struct {
+		name   string
+		lookup func(s *mysqlStorage) ([]string, error)
+		rows   [][]driver.Value
+		query  string
+		uuids  []string
+	}{
+		{
+			name: "profile name",
+			lookup: func(s *mysqlStorage) ([]string, error) {
+				return s.profileUUIDs("jose muller")
+			},
+			rows: [][]driver.Value{
+				{"u1", "José Müller"},
+				{"u1", "JOSE MULLER "},
+				{"u2", "Jose  Muller"},
+				{"u3", "José Muller"},
+			},
+			query: "select distinct uuid, name from profiles where name = ? jose muller",
+			uuids: []string{"u1", "u3"},
+		},
+		{
+			name: "letters without decomposition are not transliterated",
+			lookup: func(s *mysqlStorage) ([]string, error) {
+				return s.profileUUIDs("Soren Kierkegaard")
+			},
+			rows:  [][]driver.Value{{"u1", "Søren Kierkegaard"}},
+			query: "select distinct uuid, name from profiles where name = ? Soren Kierkegaard",
+		},
+		{
+			name: "identity source, username and email",
+			lookup: func(s *mysqlStorage) ([]string, error) {
+				source, username, email := "github", "JSmith", "j@smith.com"
+				return s.identityUUIDs(identityQuery{source: &source, username: &username, email: &email})
+			},
+			rows: [][]driver.Value{
+				{"u1", "jsmith", "J@Smith.com"},
+				{"u2", "jsmith", nil},
+			},
+			query: "select distinct uuid, username, email from identities where source = ? and username = ? and email = ? github,JSmith,j@smith.com",
+			uuids: []string{"u1"},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			connector := &fakeQueryConnector{rows: tc.rows}
+			db := sql.OpenDB(connector)
+			defer func() { _ = db.Close() }()
+			uuids, err := tc.lookup(newMySQLStorage(db))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(connector.queries) != 1 || connector.queries[0] != tc.query {
+				t.Errorf("expected query %q, got %q", tc.query, connector.queries)
+			}
+			if strings.Join(uuids, ",") != strings.Join(tc.uuids, ",") {
+				t.Errorf("expected uuids %v, got %v", tc.uuids, uuids)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var gYAMLErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// identitiesStream - reads identities file one person (top level list item) at a time
+// FINOS identities files are block sequences with items starting with '-' at column 0, every such item is parsed
+// separately so only a single item is kept in memory (anchors can't be shared between items)
+// Files in other layouts (flow sequence, leading document marker etc.) are parsed as a whole
+type identitiesStream struct {
+	fileName string
+	file     *os.File
+	reader   *bufio.Reader
+	line     int          // number of lines read so far
+	pending  []byte       // first line of the next item when already read
+	items    []*yaml.Node // items of a file parsed as a whole
+	whole    bool
+	done     bool
+}
+
+func openIdentitiesStream(fileName string) (*identitiesStream, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	s := &identitiesStream{fileName: fileName, file: file, reader: bufio.NewReader(file)}
+	// skip leading comments and empty lines, decide how to parse file on the first significant line
+	preamble := []byte{}
+	for {
+		line, err := s.readLine()
+		if err == io.EOF {
+			s.done = true
+			return s, nil
+		}
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		trimmed := strings.TrimSpace(string(line))
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			preamble = append(preamble, line...)
+			continue
+		}
+		if isItemStart(line) {
+			s.pending = line
+			return s, nil
+		}
+		preamble = append(preamble, line...)
+		break
+	}
+	err = s.parseWhole(preamble)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *identitiesStream) close() {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+// readLine - returns next line including new line character
+func (s *identitiesStream) readLine() ([]byte, error) {
+	line, err := s.reader.ReadBytes('\n')
+	if len(line) > 0 {
+		s.line++
+		return line, nil
+	}
+	return nil, err
+}
+
+// isItemStart - line starting a top level block sequence item
+func isItemStart(line []byte) bool {
+	return len(line) > 0 && line[0] == '-' && (len(line) == 1 || line[1] == ' ' || line[1] == '\t' || line[1] == '\n' || line[1] == '\r')
+}
+
+// isDocumentMarker - '---' or '...' ending the first document, like yaml.Unmarshal later documents are ignored
+func isDocumentMarker(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("---")) || bytes.HasPrefix(line, []byte("..."))
+}
+
+func (s *identitiesStream) parseWhole(head []byte) error {
+	s.whole = true
+	rest, err := ioutil.ReadAll(s.reader)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	err = yaml.Unmarshal(append(head, rest...), &root)
+	if err != nil {
+		return validationProblem{file: s.fileName, msg: err.Error()}
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	list := root.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		return validationProblem{file: s.fileName, line: list.Line, msg: "identities file must be a list of identities"}
+	}
+	s.items = list.Content
+	return nil
+}
+
+// nextItem - returns next item or io.EOF, validationProblem errors are related to a single item
+// and reading can continue with the next item
+func (s *identitiesStream) nextItem() (*yaml.Node, error) {
+	if s.whole {
+		if len(s.items) == 0 {
+			return nil, io.EOF
+		}
+		item := s.items[0]
+		s.items = s.items[1:]
+		return item, nil
+	}
+	if s.done || s.pending == nil {
+		return nil, io.EOF
+	}
+	startLine := s.line
+	chunk := s.pending
+	s.pending = nil
+	for {
+		line, err := s.readLine()
+		if err == io.EOF {
+			s.done = true
+			break
+		}
+		if err != nil {
+			s.done = true
+			return nil, fmt.Errorf("%s:%d: %v", s.fileName, s.line, err)
+		}
+		if isDocumentMarker(line) {
+			s.done = true
+			break
+		}
+		if isItemStart(line) {
+			s.pending = line
+			break
+		}
+		chunk = append(chunk, line...)
+	}
+	var root yaml.Node
+	err := yaml.Unmarshal(chunk, &root)
+	if err != nil {
+		// yaml error line numbers are relative to the item
+		msg := gYAMLErrorLine.ReplaceAllStringFunc(err.Error(), func(m string) string {
+			n, _ := strconv.Atoi(strings.TrimPrefix(m, "line "))
+			return fmt.Sprintf("line %d", n+startLine-1)
+		})
+		return nil, validationProblem{file: s.fileName, line: startLine, msg: msg}
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.SequenceNode || len(root.Content[0].Content) != 1 {
+		return nil, validationProblem{file: s.fileName, line: startLine, msg: "cannot parse list item"}
+	}
+	item := root.Content[0].Content[0]
+	shiftLines(item, startLine-1)
+	return item, nil
+}
+
+// shiftLines - makes line numbers of a node parsed from a file fragment relative to the whole file
+func shiftLines(node *yaml.Node, offset int) {
+	node.Line += offset
+	for _, child := range node.Content {
+		shiftLines(child, offset)
+	}
+}
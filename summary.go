@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cStatusSuccess     = "success"
+	cStatusInterrupted = "interrupted"
+	cStatusFailed      = "failed"
+	cSummaryFile       = "import_finos_identities_summary"
+)
+
+var (
+	gSummary    = newRunSummary()
+	gReportOnce = &sync.Once{}
+	// gReportRun - only import reports its run, other commands failing must not replace import's summary and metrics
+	gReportRun = false
+)
+
+// summaryInput - input file with its checksum and project slugs it was imported into
+type summaryInput struct {
+	File         string   `json:"file"`
+	SHA256       string   `json:"sha256"`
+	ProjectSlugs []string `json:"project_slugs"`
+}
+
+// summaryPhase - single phase (or per project slug enrollments sync group) duration and counters
+type summaryPhase struct {
+	DurationSeconds *float64       `json:"duration_seconds,omitempty"`
+	Counters        map[string]int `json:"counters"`
+}
+
+// runSummary - machine-readable result of a single run, saved into SUMMARY_JSON file
+type runSummary struct {
+	mtx               *sync.Mutex
+	RunID             string                  `json:"run_id"`
+	Started           time.Time               `json:"started"`
+	Finished          time.Time               `json:"finished"`
+	DurationSeconds   float64                 `json:"duration_seconds"`
+	Inputs            []summaryInput          `json:"inputs"`
+	ProjectSlugs      []string                `json:"project_slugs"`
+	Phases            map[string]summaryPhase `json:"phases"`
+	MissingProfiles   int                     `json:"missing_profiles"`
+	AmbiguousProfiles int                     `json:"ambiguous_profiles"`
+	MissingOrgs       int                     `json:"missing_orgs"`
+	Errors            []string                `json:"errors"`
+	Status            string                  `json:"status"`
+	ExitCode          int                     `json:"exit_code"`
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		mtx:          &sync.Mutex{},
+		Started:      time.Now(),
+		Inputs:       []summaryInput{},
+		ProjectSlugs: []string{},
+		Errors:       []string{},
+	}
+}
+
+func fileSHA256(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addInput - records input file, its checksum and project slugs
+func (s *runSummary) addInput(fileName string, slugs []string) {
+	sum, err := fileSHA256(fileName)
+	fatalOnError(err)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Inputs = append(s.Inputs, summaryInput{File: fileName, SHA256: sum, ProjectSlugs: slugs})
+	for _, slug := range slugs {
+		found := false
+		for _, existing := range s.ProjectSlugs {
+			if existing == slug {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.ProjectSlugs = append(s.ProjectSlugs, slug)
+		}
+	}
+	sort.Strings(s.ProjectSlugs)
+}
+
+func (s *runSummary) addError(err error) {
+	s.mtx.Lock()
+	s.Errors = append(s.Errors, err.Error())
+	s.mtx.Unlock()
+}
+
+// phases - snapshot of all stats groups
+func (s *runStats) phases() map[string]summaryPhase {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	phases := make(map[string]summaryPhase)
+	for _, group := range s.groups {
+		phase := summaryPhase{Counters: make(map[string]int)}
+		duration, ok := s.durations[group]
+		if ok {
+			seconds := duration.Seconds()
+			phase.DurationSeconds = &seconds
+		}
+		for name, value := range s.counters[group] {
+			phase.Counters[name] = value
+		}
+		phases[group] = phase
+	}
+	return phases
+}
+
+// reportRun - saves run summary and metrics, only the first call (final status) is reported and only for import
+// It is also called from fatalOnError, so it cannot use fatalOnError itself
+func reportRun(status string, exitCode int) {
+	if !gReportRun {
+		return
+	}
+	gReportOnce.Do(func() {
+		gSummary.finish(status, exitCode)
+		gSummary.write()
+		exportMetrics(gSummary)
+	})
+}
+
+// finish - sets final status and collects all counters
+func (s *runSummary) finish(status string, exitCode int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.RunID = gRunID
+	s.Finished = time.Now()
+	s.DurationSeconds = s.Finished.Sub(s.Started).Seconds()
+	s.Phases = gStats.phases()
+	s.MissingProfiles = s.Phases[cPhaseLookup].Counters["missing"]
+	s.AmbiguousProfiles = s.Phases[cPhaseLookup].Counters["ambiguous"]
+	s.MissingOrgs = s.Phases[cPhaseOrgMapping].Counters["missing"]
+	s.Status = status
+	s.ExitCode = exitCode
+}
+
+// write - saves summary into SUMMARY_JSON file, default is per run: import_finos_identities_summary_<run id>.json
+func (s *runSummary) write() {
+	fileName := os.Getenv("SUMMARY_JSON")
+	if fileName == "" {
+		fileName = cSummaryFile
+		if gRunID != "" {
+			fileName += "_" + gRunID
+		}
+		fileName += ".json"
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(fileName, data, 0644)
+	}
+	if err != nil {
+		gLog.error("cannot write summary", "file", fileName, "error", err)
+		return
+	}
+	gLog.info("summary saved", "file", fileName)
+}
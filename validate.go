@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// gIdentitySources - data source keys allowed in identities records (lists of usernames), EXTRA_SOURCES adds more
+var gIdentitySources = []string{
+	"bugzilla", "bugzillarest", "confluence", "discourse", "dockerhub", "gerrit", "git", "github", "gitlab", "googlegroups",
+	"groupsio", "hyperkitty", "jenkins", "jira", "linkedin", "mbox", "mediawiki", "meetup", "pipermail", "rocketchat",
+	"slack", "stackexchange", "twitter",
+}
+
+// validationProblem - schema violation at a given line of identities file
+type validationProblem struct {
+	file string
+	line int
+	msg  string
+}
+
+func (p validationProblem) String() string {
+	if p.line == 0 {
+		return fmt.Sprintf("%s: %s", p.file, p.msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.file, p.line, p.msg)
+}
+
+func (p validationProblem) Error() string {
+	return p.String()
+}
+
+// identitiesValidator - checks identities file against schema described in README (Validation), collects all problems
+type identitiesValidator struct {
+	file     string
+	sources  map[string]struct{}
+	problems []validationProblem
+}
+
+func newIdentitiesValidator(file string) *identitiesValidator {
+	v := &identitiesValidator{file: file, sources: make(map[string]struct{})}
+	for _, source := range gIdentitySources {
+		v.sources[source] = struct{}{}
+	}
+	for _, source := range strings.Split(os.Getenv("EXTRA_SOURCES"), ",") {
+		source = strings.TrimSpace(source)
+		if source != "" {
+			v.sources[source] = struct{}{}
+		}
+	}
+	return v
+}
+
+func (v *identitiesValidator) problem(node *yaml.Node, f string, a ...interface{}) {
+	line := 0
+	if node != nil {
+		line = node.Line
+	}
+	v.problems = append(v.problems, validationProblem{file: v.file, line: line, msg: fmt.Sprintf(f, a...)})
+}
+
+// mapping - returns key nodes and value nodes of a mapping, reports a problem when node is not a mapping
+func (v *identitiesValidator) mapping(node *yaml.Node, what string) (keys, values []*yaml.Node, ok bool) {
+	if node.Kind != yaml.MappingNode {
+		v.problem(node, "%s must be a mapping", what)
+		return
+	}
+	seen := make(map[string]struct{})
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if _, dup := seen[key.Value]; dup {
+			v.problem(key, "%s key '%s' is defined more than once", what, key.Value)
+			continue
+		}
+		seen[key.Value] = struct{}{}
+		keys = append(keys, key)
+		values = append(values, node.Content[i+1])
+	}
+	ok = true
+	return
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+func (v *identitiesValidator) str(node *yaml.Node, what string, required bool) {
+	if node.Kind != yaml.ScalarNode || (node.Tag != "!!str" && !isNull(node)) {
+		v.problem(node, "%s must be a string", what)
+		return
+	}
+	if required && node.Value == "" {
+		v.problem(node, "%s must not be empty", what)
+	}
+}
+
+func (v *identitiesValidator) strList(node *yaml.Node, what string) {
+	if node.Kind != yaml.SequenceNode {
+		v.problem(node, "%s must be a list of strings", what)
+		return
+	}
+	for _, item := range node.Content {
+		if item.Kind != yaml.ScalarNode || item.Tag != "!!str" || item.Value == "" {
+			v.problem(item, "%s item '%s' must be a non-empty string", what, item.Value)
+		}
+	}
+}
+
+// date - checks date value the way import parses it (see parseEnrollmentDate)
+func (v *identitiesValidator) date(node *yaml.Node, what string, end bool) (dt time.Time, ok bool) {
+	dt, err := parseEnrollmentDateNode(node, end)
+	if err != nil {
+		v.problem(node, "%s: %v", what, err)
+		return
+	}
+	ok = true
+	return
+}
+
+func (v *identitiesValidator) profile(node *yaml.Node) {
+	keys, values, ok := v.mapping(node, "profile")
+	if !ok {
+		return
+	}
+	hasName := false
+	for i, key := range keys {
+		value := values[i]
+		switch key.Value {
+		case "name":
+			hasName = true
+			v.str(value, "profile.name", true)
+		case "is_bot":
+			if value.Kind != yaml.ScalarNode || (value.Tag != "!!bool" && !isNull(value)) {
+				v.problem(value, "profile.is_bot must be true or false")
+			}
+		case "email":
+			v.str(value, "profile.email", false)
+			if value.Tag == "!!str" && value.Value != "" && !isEmail(value.Value) {
+				v.problem(value, "profile.email '%s' is not a valid email", value.Value)
+			}
+		case "gender":
+			v.str(value, "profile.gender", false)
+		case "country_code":
+			v.str(value, "profile.country_code", false)
+			if value.Tag == "!!str" && value.Value != "" && !isCountryCode(strings.TrimSpace(value.Value)) {
+				v.problem(value, "profile.country_code '%s' is not an ISO 3166-1 alpha-2 country code", value.Value)
+			}
+		default:
+			v.problem(key, "unknown profile key '%s', allowed: name, email, gender, country_code, is_bot", key.Value)
+		}
+	}
+	if !hasName {
+		v.problem(node, "profile.name is required")
+	}
+}
+
+func (v *identitiesValidator) enrollment(node *yaml.Node) {
+	keys, values, ok := v.mapping(node, "enrollment")
+	if !ok {
+		return
+	}
+	var (
+		start, end           time.Time
+		startNode, endNode   *yaml.Node
+		startValid, endValid bool
+	)
+	hasOrg := false
+	for i, key := range keys {
+		value := values[i]
+		switch key.Value {
+		case "organization":
+			hasOrg = true
+			v.str(value, "enrollment organization", true)
+		case "start":
+			startNode = value
+			start, startValid = v.date(value, "enrollment start", false)
+		case "end":
+			endNode = value
+			end, endValid = v.date(value, "enrollment end", true)
+		case "project_slug":
+			v.str(value, "enrollment project_slug", false)
+		default:
+			v.problem(key, "unknown enrollment key '%s', allowed: organization, start, end, project_slug", key.Value)
+		}
+	}
+	if !hasOrg {
+		v.problem(node, "enrollment organization is required")
+	}
+	if startValid && endValid && !start.Before(end) {
+		v.problem(endNode, "enrollment end '%s' must be after start '%s'", endNode.Value, startNode.Value)
+	}
+}
+
+func (v *identitiesValidator) identity(node *yaml.Node) {
+	keys, values, ok := v.mapping(node, "identity")
+	if !ok {
+		return
+	}
+	hasProfile := false
+	for i, key := range keys {
+		value := values[i]
+		switch key.Value {
+		case "profile":
+			hasProfile = true
+			v.profile(value)
+		case "enrollments":
+			if isNull(value) {
+				continue
+			}
+			if value.Kind != yaml.SequenceNode {
+				v.problem(value, "enrollments must be a list")
+				continue
+			}
+			for _, item := range value.Content {
+				v.enrollment(item)
+			}
+		case "email":
+			if !isNull(value) {
+				v.strList(value, "email")
+			}
+		case "project_slug":
+			v.str(value, "project_slug", false)
+		default:
+			if _, ok := v.sources[key.Value]; !ok {
+				v.problem(key, "unknown key '%s', it is not a known data source (EXTRA_SOURCES adds more)", key.Value)
+				continue
+			}
+			v.strList(value, key.Value)
+		}
+	}
+	if !hasProfile {
+		v.problem(node, "profile is required")
+	}
+}
+
+// validateIdentitiesFile - checks identities file item by item, returns all problems found
+func validateIdentitiesFile(fileName string) []validationProblem {
+	v := newIdentitiesValidator(fileName)
+	stream, err := openIdentitiesStream(fileName)
+	if err != nil {
+		problem, ok := err.(validationProblem)
+		if !ok {
+			problem = validationProblem{file: fileName, msg: err.Error()}
+		}
+		return []validationProblem{problem}
+	}
+	defer stream.close()
+	for {
+		item, err := stream.nextItem()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problem, ok := err.(validationProblem)
+			if !ok {
+				v.problems = append(v.problems, validationProblem{file: fileName, msg: err.Error()})
+				break
+			}
+			v.problems = append(v.problems, problem)
+			continue
+		}
+		v.identity(item)
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].line < v.problems[j].line
+	})
+	return v.problems
+}
+
+func validateIdentitiesFiles(fileNames []string) (problems []validationProblem) {
+	for _, fileName := range fileNames {
+		problems = append(problems, validateIdentitiesFile(fileName)...)
+	}
+	return
+}
+
+// inputFileNames - files given on command line or listed in PROJECTS_MANIFEST
+func inputFileNames(args []string) []string {
+	if len(args) > 0 {
+		return args
+	}
+	manifest := readProjectsManifest(os.Getenv("PROJECTS_MANIFEST"))
+	return manifest.fileNames()
+}
+
+// validationPreflight - validates all input files before import, logs problems and refuses to continue when there are any
+// SKIP_VALIDATION=1 skips it
+func validationPreflight(fileNames []string) (ok bool) {
+	if os.Getenv("SKIP_VALIDATION") != "" {
+		gLog.warn("identities files validation skipped")
+		return true
+	}
+	problems := validateIdentitiesFiles(fileNames)
+	for _, problem := range problems {
+		gLog.error("invalid identities file", "source", fmt.Sprintf("%s:%d", problem.file, problem.line), "problem", problem.msg)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+	gLog.info("identities files are valid", "files", len(fileNames))
+	return true
+}
+
+func runValidate(args []string) int {
+	fileNames := inputFileNames(args)
+	if len(fileNames) == 0 {
+		fmt.Fprintf(os.Stderr, "Arguments required: file.yaml [file2.yaml ...] (or PROJECTS_MANIFEST=manifest.yaml)\n")
+		return 2
+	}
+	problems := validateIdentitiesFiles(fileNames)
+	for _, problem := range problems {
+		fmt.Printf("%s\n", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %d file(s)\n", len(problems), len(fileNames))
+		return 1
+	}
+	return 0
+}